@@ -3,6 +3,8 @@ package ast
 import (
 	"bytes"
 	"lang_vm/token"
+	"strconv"
+	"strings"
 )
 
 type Expression interface {
@@ -13,6 +15,8 @@ type Expression interface {
 type Node interface {
 	TokenLiteral() string
 	String() string
+	// Span returns the source range covered by the node.
+	Span() token.Span
 }
 
 type Statement interface {
@@ -20,6 +24,16 @@ type Statement interface {
 	statementNode()
 }
 
+// spanFrom returns the span from the start of tok to the end of last. A
+// missing last node, e.g. after a parse error, yields the span of tok.
+func spanFrom(tok token.Token, last Node) token.Span {
+	if last == nil {
+		return tok.Span
+	}
+
+	return token.Span{Start: tok.Span.Start, End: last.Span().End}
+}
+
 type Program struct {
 	Statements []Statement
 }
@@ -32,6 +46,17 @@ func (p *Program) TokenLiteral() string {
 	}
 }
 
+func (p *Program) Span() token.Span {
+	if len(p.Statements) == 0 {
+		return token.Span{}
+	}
+
+	return token.Span{
+		Start: p.Statements[0].Span().Start,
+		End:   p.Statements[len(p.Statements)-1].Span().End,
+	}
+}
+
 func (p *Program) String() string {
 	var out bytes.Buffer
 
@@ -42,6 +67,69 @@ func (p *Program) String() string {
 	return out.String()
 }
 
+type LetStatement struct {
+	Token token.Token // the token.Let token
+	Name  *Identifier
+	Value Expression
+}
+
+func (ls *LetStatement) TokenLiteral() string {
+	return ls.Token.Literal
+}
+
+func (ls *LetStatement) Span() token.Span {
+	if ls.Value == nil {
+		return spanFrom(ls.Token, ls.Name)
+	}
+
+	return spanFrom(ls.Token, ls.Value)
+}
+
+func (ls *LetStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(ls.TokenLiteral() + " ")
+	out.WriteString(ls.Name.String())
+	out.WriteString(" = ")
+	if ls.Value != nil {
+		out.WriteString(ls.Value.String())
+	}
+	out.WriteString(";")
+
+	return out.String()
+}
+
+func (ls *LetStatement) statementNode() {
+}
+
+type ReturnStatement struct {
+	Token       token.Token // the token.Return token
+	ReturnValue Expression
+}
+
+func (rs *ReturnStatement) TokenLiteral() string {
+	return rs.Token.Literal
+}
+
+func (rs *ReturnStatement) Span() token.Span {
+	return spanFrom(rs.Token, rs.ReturnValue)
+}
+
+func (rs *ReturnStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(rs.TokenLiteral() + " ")
+	if rs.ReturnValue != nil {
+		out.WriteString(rs.ReturnValue.String())
+	}
+	out.WriteString(";")
+
+	return out.String()
+}
+
+func (rs *ReturnStatement) statementNode() {
+}
+
 type ExpressionStatement struct {
 	Token      token.Token // the first token of the expression
 	Expression Expression
@@ -51,6 +139,10 @@ func (es *ExpressionStatement) TokenLiteral() string {
 	return es.Token.Literal
 }
 
+func (es *ExpressionStatement) Span() token.Span {
+	return spanFrom(es.Token, es.Expression)
+}
+
 func (es *ExpressionStatement) String() string {
 	if es.Expression != nil {
 		return es.Expression.String()
@@ -61,6 +153,33 @@ func (es *ExpressionStatement) String() string {
 func (es *ExpressionStatement) statementNode() {
 }
 
+type PrefixExpression struct {
+	Token    token.Token // the prefix token, e.g. !
+	Operator string
+	Right    Expression
+}
+
+func (pe *PrefixExpression) TokenLiteral() string {
+	return pe.Token.Literal
+}
+
+func (pe *PrefixExpression) Span() token.Span {
+	return spanFrom(pe.Token, pe.Right)
+}
+
+func (pe *PrefixExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(token.LeftParen)
+	out.WriteString(pe.Operator)
+	out.WriteString(pe.Right.String())
+	out.WriteString(token.RightParen)
+
+	return out.String()
+}
+
+func (pe *PrefixExpression) expressionNode() {}
+
 type BinaryExpression struct {
 	Left     Expression
 	Right    Expression
@@ -72,6 +191,21 @@ func (b *BinaryExpression) TokenLiteral() string {
 	return b.Token.Literal
 }
 
+func (b *BinaryExpression) Span() token.Span {
+	if b.Left == nil {
+		return spanFrom(b.Token, b.Right)
+	}
+
+	span := b.Left.Span()
+	if b.Right != nil {
+		span.End = b.Right.Span().End
+	} else {
+		span.End = b.Token.Span.End
+	}
+
+	return span
+}
+
 func (b *BinaryExpression) String() string {
 	var out bytes.Buffer
 
@@ -86,6 +220,26 @@ func (b *BinaryExpression) String() string {
 
 func (b *BinaryExpression) expressionNode() {}
 
+type Identifier struct {
+	Token token.Token
+	Value string
+}
+
+func (i *Identifier) TokenLiteral() string {
+	return i.Token.Literal
+}
+
+func (i *Identifier) Span() token.Span {
+	return i.Token.Span
+}
+
+func (i *Identifier) String() string {
+	return i.Value
+}
+
+func (i *Identifier) expressionNode() {
+}
+
 type IntegerLiteral struct {
 	Token token.Token
 	Value int64
@@ -95,6 +249,10 @@ func (il *IntegerLiteral) TokenLiteral() string {
 	return il.Token.Literal
 }
 
+func (il *IntegerLiteral) Span() token.Span {
+	return il.Token.Span
+}
+
 func (il *IntegerLiteral) String() string {
 	return il.Token.Literal
 }
@@ -102,15 +260,60 @@ func (il *IntegerLiteral) String() string {
 func (il *IntegerLiteral) expressionNode() {
 }
 
+type StringLiteral struct {
+	Token token.Token
+	Value string
+}
+
+func (sl *StringLiteral) TokenLiteral() string {
+	return sl.Token.Literal
+}
+
+func (sl *StringLiteral) Span() token.Span {
+	return sl.Token.Span
+}
+
+func (sl *StringLiteral) String() string {
+	return strconv.Quote(sl.Value)
+}
+
+func (sl *StringLiteral) expressionNode() {
+}
+
+type Boolean struct {
+	Token token.Token
+	Value bool
+}
+
+func (b *Boolean) TokenLiteral() string {
+	return b.Token.Literal
+}
+
+func (b *Boolean) Span() token.Span {
+	return b.Token.Span
+}
+
+func (b *Boolean) String() string {
+	return b.Token.Literal
+}
+
+func (b *Boolean) expressionNode() {
+}
+
 type BlockStatement struct {
-	Token      token.Token
+	Token      token.Token // the '{' token
 	Statements []Statement
+	RightBrace token.Token
 }
 
 func (b *BlockStatement) TokenLiteral() string {
 	return b.Token.Literal
 }
 
+func (b *BlockStatement) Span() token.Span {
+	return token.Span{Start: b.Token.Span.Start, End: b.RightBrace.Span.End}
+}
+
 func (b *BlockStatement) String() string {
 	var out bytes.Buffer
 
@@ -138,6 +341,17 @@ func (i *IfExpression) TokenLiteral() string {
 	return i.Token.Literal
 }
 
+func (i *IfExpression) Span() token.Span {
+	if i.Alternative != nil {
+		return spanFrom(i.Token, i.Alternative)
+	}
+	if i.Consequence != nil {
+		return spanFrom(i.Token, i.Consequence)
+	}
+
+	return spanFrom(i.Token, i.Condition)
+}
+
 func (i *IfExpression) String() string {
 	var out bytes.Buffer
 
@@ -155,3 +369,178 @@ func (i *IfExpression) String() string {
 }
 
 func (i *IfExpression) expressionNode() {}
+
+type FunctionLiteral struct {
+	Token      token.Token // the token.Function token
+	Parameters []*Identifier
+	Body       *BlockStatement
+
+	// Name is the identifier the function is bound to by a let statement,
+	// empty for anonymous functions.
+	Name string
+}
+
+func (fl *FunctionLiteral) TokenLiteral() string {
+	return fl.Token.Literal
+}
+
+func (fl *FunctionLiteral) Span() token.Span {
+	if fl.Body == nil {
+		return fl.Token.Span
+	}
+
+	return spanFrom(fl.Token, fl.Body)
+}
+
+func (fl *FunctionLiteral) String() string {
+	var out bytes.Buffer
+
+	params := make([]string, 0, len(fl.Parameters))
+	for _, p := range fl.Parameters {
+		params = append(params, p.String())
+	}
+
+	out.WriteString(fl.TokenLiteral())
+	out.WriteString("(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(") ")
+	out.WriteString(fl.Body.String())
+
+	return out.String()
+}
+
+func (fl *FunctionLiteral) expressionNode() {}
+
+type CallExpression struct {
+	Token      token.Token // the '(' token
+	Function   Expression  // Identifier or FunctionLiteral
+	Arguments  []Expression
+	RightParen token.Token
+}
+
+func (ce *CallExpression) TokenLiteral() string {
+	return ce.Token.Literal
+}
+
+func (ce *CallExpression) Span() token.Span {
+	if ce.Function == nil {
+		return token.Span{Start: ce.Token.Span.Start, End: ce.RightParen.Span.End}
+	}
+
+	return token.Span{Start: ce.Function.Span().Start, End: ce.RightParen.Span.End}
+}
+
+func (ce *CallExpression) String() string {
+	var out bytes.Buffer
+
+	args := make([]string, 0, len(ce.Arguments))
+	for _, a := range ce.Arguments {
+		args = append(args, a.String())
+	}
+
+	out.WriteString(ce.Function.String())
+	out.WriteString("(")
+	out.WriteString(strings.Join(args, ", "))
+	out.WriteString(")")
+
+	return out.String()
+}
+
+func (ce *CallExpression) expressionNode() {}
+
+type ArrayLiteral struct {
+	Token        token.Token // the '[' token
+	Elements     []Expression
+	RightBracket token.Token
+}
+
+func (al *ArrayLiteral) TokenLiteral() string {
+	return al.Token.Literal
+}
+
+func (al *ArrayLiteral) Span() token.Span {
+	return token.Span{Start: al.Token.Span.Start, End: al.RightBracket.Span.End}
+}
+
+func (al *ArrayLiteral) String() string {
+	var out bytes.Buffer
+
+	elements := make([]string, 0, len(al.Elements))
+	for _, el := range al.Elements {
+		elements = append(elements, el.String())
+	}
+
+	out.WriteString("[")
+	out.WriteString(strings.Join(elements, ", "))
+	out.WriteString("]")
+
+	return out.String()
+}
+
+func (al *ArrayLiteral) expressionNode() {}
+
+type IndexExpression struct {
+	Token        token.Token // the '[' token
+	Left         Expression
+	Index        Expression
+	RightBracket token.Token
+}
+
+func (ie *IndexExpression) TokenLiteral() string {
+	return ie.Token.Literal
+}
+
+func (ie *IndexExpression) Span() token.Span {
+	return token.Span{Start: ie.Left.Span().Start, End: ie.RightBracket.Span.End}
+}
+
+func (ie *IndexExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(ie.Left.String())
+	out.WriteString("[")
+	out.WriteString(ie.Index.String())
+	out.WriteString("])")
+
+	return out.String()
+}
+
+func (ie *IndexExpression) expressionNode() {}
+
+type HashPair struct {
+	Key   Expression
+	Value Expression
+}
+
+// HashLiteral keeps its pairs in source order.
+type HashLiteral struct {
+	Token      token.Token // the '{' token
+	Pairs      []HashPair
+	RightBrace token.Token
+}
+
+func (hl *HashLiteral) TokenLiteral() string {
+	return hl.Token.Literal
+}
+
+func (hl *HashLiteral) Span() token.Span {
+	return token.Span{Start: hl.Token.Span.Start, End: hl.RightBrace.Span.End}
+}
+
+func (hl *HashLiteral) String() string {
+	var out bytes.Buffer
+
+	pairs := make([]string, 0, len(hl.Pairs))
+	for _, pair := range hl.Pairs {
+		pairs = append(pairs, pair.Key.String()+": "+pair.Value.String())
+	}
+
+	out.WriteString("{")
+	out.WriteString(strings.Join(pairs, ", "))
+	out.WriteString("}")
+
+	return out.String()
+}
+
+func (hl *HashLiteral) expressionNode() {}
@@ -0,0 +1,246 @@
+package code
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Assembly is the result of Assemble.
+type Assembly struct {
+	Instructions Instructions
+
+	// Constants holds the values of the .const directives in pool order,
+	// each an int64 or a string.
+	Constants []interface{}
+}
+
+// Assemble translates a listing into instructions. It is the inverse of
+// Instructions.String and Disassemble, so their output assembles back into
+// the same instructions. A listing has one instruction per line:
+//
+//	; comments run to the end of the line
+//	.const two 2        ; adds 2 to the constant pool, named two
+//	.const "hi"         ; constants don't need a name
+//	loop:               ; labels name the offset of the next instruction
+//	0003 OpConstant two ; a leading offset is checked against the actual one
+//	OpJumpNotTruthy loop
+//
+// Operands are numbers, labels or constant names. Source lines printed by
+// Disassemble ("   1 | ...") are skipped.
+func Assemble(text string) (*Assembly, error) {
+	a := &assembler{names: make(map[string]int)}
+
+	lines := strings.Split(text, "\n")
+
+	// the first pass assigns offsets to labels, so that jumps can refer to
+	// labels further down
+	for pass := 1; pass <= 2; pass++ {
+		a.pass = pass
+		a.offset = 0
+		a.asm = &Assembly{Instructions: Instructions{}}
+
+		for i, line := range lines {
+			if err := a.line(line); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+		}
+	}
+
+	return a.asm, nil
+}
+
+type assembler struct {
+	pass   int
+	offset int
+	asm    *Assembly
+
+	// names maps labels to offsets and constant names to pool indexes.
+	names map[string]int
+}
+
+func (a *assembler) line(line string) error {
+	line = strings.TrimSpace(stripComment(line))
+	if line == "" || isSourceLine(line) {
+		return nil
+	}
+
+	if strings.HasPrefix(line, ".const") {
+		return a.constant(strings.TrimSpace(strings.TrimPrefix(line, ".const")))
+	}
+
+	fields := strings.Fields(line)
+
+	if label := fields[0]; strings.HasSuffix(label, ":") {
+		if err := a.define(strings.TrimSuffix(label, ":"), a.offset); err != nil {
+			return err
+		}
+
+		fields = fields[1:]
+		if len(fields) == 0 {
+			return nil
+		}
+	}
+
+	if offset, err := strconv.Atoi(fields[0]); err == nil {
+		if offset != a.offset {
+			return fmt.Errorf("listed offset %04d, but instruction is at %04d", offset, a.offset)
+		}
+
+		fields = fields[1:]
+		if len(fields) == 0 {
+			return fmt.Errorf("offset without instruction")
+		}
+	}
+
+	return a.instruction(fields[0], fields[1:])
+}
+
+func (a *assembler) instruction(name string, args []string) error {
+	op, ok := opCodesByName[name]
+	if !ok {
+		return fmt.Errorf("unknown instruction %s", name)
+	}
+
+	def := definitions[op]
+	if len(args) != len(def.OperandWidths) {
+		return fmt.Errorf("%s takes %d operands, got %d", name, len(def.OperandWidths), len(args))
+	}
+
+	operands := make([]int, len(args))
+	for i, arg := range args {
+		operand, err := a.operand(arg)
+		if err != nil {
+			return err
+		}
+
+		if max := 1<<(8*def.OperandWidths[i]) - 1; operand < 0 || operand > max {
+			return fmt.Errorf("operand %d of %s out of range, at most %d is allowed", operand, name, max)
+		}
+		operands[i] = operand
+	}
+
+	ins := Make(op, operands...)
+	a.asm.Instructions = append(a.asm.Instructions, ins...)
+	a.offset += len(ins)
+
+	return nil
+}
+
+func (a *assembler) operand(arg string) (int, error) {
+	if n, err := strconv.Atoi(arg); err == nil {
+		return n, nil
+	}
+
+	if !isName(arg) {
+		return 0, fmt.Errorf("invalid operand %s", arg)
+	}
+
+	value, ok := a.names[arg]
+	if !ok && a.pass == 2 {
+		return 0, fmt.Errorf("undefined name %s", arg)
+	}
+
+	return value, nil
+}
+
+// constant handles a .const directive: an optional name and an integer or
+// a quoted string.
+func (a *assembler) constant(directive string) error {
+	name := ""
+	if fields := strings.Fields(directive); len(fields) > 1 && isName(fields[0]) {
+		name = fields[0]
+		directive = strings.TrimSpace(strings.TrimPrefix(directive, name))
+	}
+
+	var value interface{}
+	if strings.HasPrefix(directive, `"`) {
+		s, err := strconv.Unquote(directive)
+		if err != nil {
+			return fmt.Errorf("invalid string constant %s", directive)
+		}
+		value = s
+	} else {
+		n, err := strconv.ParseInt(directive, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid constant %q", directive)
+		}
+		value = n
+	}
+
+	if name != "" {
+		if err := a.define(name, len(a.asm.Constants)); err != nil {
+			return err
+		}
+	}
+	a.asm.Constants = append(a.asm.Constants, value)
+
+	return nil
+}
+
+func (a *assembler) define(name string, value int) error {
+	if !isName(name) {
+		return fmt.Errorf("invalid name %s", name)
+	}
+
+	// names are collected in the first pass and seen again in the second
+	if _, ok := a.names[name]; ok && a.pass == 1 {
+		return fmt.Errorf("%s is already defined", name)
+	}
+	a.names[name] = value
+
+	return nil
+}
+
+var opCodesByName = func() map[string]OpCode {
+	m := make(map[string]OpCode, len(definitions))
+	for op, def := range definitions {
+		m[def.Name] = op
+	}
+
+	return m
+}()
+
+// stripComment removes a ';' comment, ignoring ';' in quoted strings.
+func stripComment(line string) string {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && inString:
+			i++
+		case line[i] == '"':
+			inString = !inString
+		case line[i] == ';' && !inString:
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// isSourceLine reports whether line is a source line printed by
+// Disassemble, a line number followed by '|'.
+func isSourceLine(line string) bool {
+	fields := strings.SplitN(line, "|", 2)
+	if len(fields) != 2 {
+		return false
+	}
+
+	_, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	return err == nil
+}
+
+func isName(s string) bool {
+	if s == "" || unicode.IsDigit(rune(s[0])) {
+		return false
+	}
+
+	for _, ch := range s {
+		if !unicode.IsLetter(ch) && !unicode.IsDigit(ch) && ch != '_' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,14 +1,17 @@
 package code
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
 )
 
 type OpCode byte
 
+// Version identifies the opcode set. Encoded byte code refers to opcodes
+// by number, so it has to be bumped whenever opcodes are added, removed or
+// reordered, or their operands change.
+const Version = 1
+
 const (
 	OpConstant OpCode = iota
 	OpPop
@@ -19,9 +22,30 @@ const (
 	OpJump
 	OpJumpNotTruthy
 	OpNull
+	OpTrue
+	OpFalse
 	OpGreaterThan
+	OpGreaterThanOrEqual
+	OpLessThan
+	OpLessThanOrEqual
 	OpEqual
 	OpNotEqual
+	OpMinus
+	OpBang
+	OpArray
+	OpIndex
+	OpHash
+	OpSetGlobal
+	OpGetGlobal
+	OpSetLocal
+	OpGetLocal
+	OpCall
+	OpReturnValue
+	OpReturn
+	OpClosure
+	OpGetFree
+	OpCurrentClosure
+	OpGetBuiltin
 	OpHalt
 )
 
@@ -30,24 +54,67 @@ type Definition struct {
 	OperandWidths []int
 }
 
+// OperandsWidth returns the number of bytes the operands take, an
+// instruction is one byte longer.
+func (d *Definition) OperandsWidth() int {
+	width := 0
+	for _, w := range d.OperandWidths {
+		width += w
+	}
+
+	return width
+}
+
 var definitions = map[OpCode]*Definition{
-	OpConstant:      {"OpConstant", []int{2}},
-	OpPop:           {"OpPop", []int{}},
-	OpAdd:           {"OpAdd", []int{}},
-	OpSub:           {"OpSub", []int{}},
-	OpMul:           {"OpMul", []int{}},
-	OpDiv:           {"OpDiv", []int{}},
-	OpJump:          {"OpJump", []int{2}},
-	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
-	OpNull:          {"OpNull", []int{}},
-	OpGreaterThan:   {"OpGreaterThan", []int{}},
-	OpEqual:         {"OpEqual", []int{}},
-	OpNotEqual:      {"OpNotEqual", []int{}},
-	OpHalt:          {"OpHalt", []int{}},
+	OpConstant:           {"OpConstant", []int{2}},
+	OpPop:                {"OpPop", []int{}},
+	OpAdd:                {"OpAdd", []int{}},
+	OpSub:                {"OpSub", []int{}},
+	OpMul:                {"OpMul", []int{}},
+	OpDiv:                {"OpDiv", []int{}},
+	OpJump:               {"OpJump", []int{2}},
+	OpJumpNotTruthy:      {"OpJumpNotTruthy", []int{2}},
+	OpNull:               {"OpNull", []int{}},
+	OpTrue:               {"OpTrue", []int{}},
+	OpFalse:              {"OpFalse", []int{}},
+	OpGreaterThan:        {"OpGreaterThan", []int{}},
+	OpGreaterThanOrEqual: {"OpGreaterThanOrEqual", []int{}},
+	OpLessThan:           {"OpLessThan", []int{}},
+	OpLessThanOrEqual:    {"OpLessThanOrEqual", []int{}},
+	OpEqual:              {"OpEqual", []int{}},
+	OpNotEqual:           {"OpNotEqual", []int{}},
+	OpMinus:              {"OpMinus", []int{}},
+	OpBang:               {"OpBang", []int{}},
+	OpArray:              {"OpArray", []int{2}},
+	OpIndex:              {"OpIndex", []int{}},
+	OpHash:               {"OpHash", []int{2}},
+	OpSetGlobal:          {"OpSetGlobal", []int{2}},
+	OpGetGlobal:          {"OpGetGlobal", []int{2}},
+	OpSetLocal:           {"OpSetLocal", []int{1}},
+	OpGetLocal:           {"OpGetLocal", []int{1}},
+	OpCall:               {"OpCall", []int{1}},
+	OpReturnValue:        {"OpReturnValue", []int{}},
+	OpReturn:             {"OpReturn", []int{}},
+	// OpClosure operands: constant index of the function, number of free
+	// variables on the stack
+	OpClosure:        {"OpClosure", []int{2, 1}},
+	OpGetFree:        {"OpGetFree", []int{1}},
+	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpGetBuiltin:     {"OpGetBuiltin", []int{1}},
+	OpHalt:           {"OpHalt", []int{}},
 }
 
 type Instructions []byte
 
+func (op OpCode) String() string {
+	def, ok := definitions[op]
+	if !ok {
+		return fmt.Sprintf("OpCode(%d)", byte(op))
+	}
+
+	return def.Name
+}
+
 func Lookup(op byte) (*Definition, error) {
 	def, ok := definitions[OpCode(op)]
 	if !ok {
@@ -80,10 +147,7 @@ func Make(op OpCode, operands ...int) []byte {
 		return []byte{}
 	}
 
-	instructionLen := 1
-	for _, w := range def.OperandWidths {
-		instructionLen += w
-	}
+	instructionLen := 1 + def.OperandsWidth()
 
 	instruction := make([]byte, instructionLen)
 	instruction[0] = byte(op)
@@ -129,28 +193,7 @@ func ReadOperands(definition *Definition, instructions Instructions) ([]int, int
 }
 
 func (ins Instructions) String() string {
-	var out bytes.Buffer
-
-	i := 0
-	for i < len(ins) {
-		def, err := Lookup(ins[i])
-		if err != nil {
-			_, err := fmt.Fprintf(&out, "ERROR: %s\n", err)
-			if err != nil {
-				log.Fatalf("failed to write to buffer, %v", err)
-			}
-		}
-
-		operands, offset := ReadOperands(def, ins[i+1:])
-
-		_, err = fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
-		if err != nil {
-			log.Fatalf("failed to write to buffer, %v", err)
-		}
-
-		i += 1 + offset
-	}
-	return out.String()
+	return Disassemble(ins, nil, "")
 }
 
 func (ins Instructions) fmtInstruction(definition *Definition, operands []int) string {
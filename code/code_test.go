@@ -2,6 +2,8 @@ package code
 
 import (
 	"fmt"
+	"lang_vm/token"
+	"reflect"
 	"testing"
 )
 
@@ -9,3 +11,201 @@ func TestOpPrint(t *testing.T) {
 	ins := Make(OpConstant, 1)
 	fmt.Println(ins)
 }
+
+func TestDefinitions(t *testing.T) {
+	for op := OpConstant; op <= OpHalt; op++ {
+		if _, err := Lookup(byte(op)); err != nil {
+			t.Errorf("opcode %d has no definition", op)
+		}
+	}
+}
+
+func TestPositionTableLookup(t *testing.T) {
+	span := func(line int) token.Span {
+		return token.Span{Start: token.Pos{Line: line, Column: 1}, End: token.Pos{Line: line, Column: 2}}
+	}
+
+	table := PositionTable{
+		{Offset: 0, Span: span(1)},
+		{Offset: 3, Span: span(2)},
+		{Offset: 4, Span: span(3)},
+	}
+
+	tests := map[string]struct {
+		ip   int
+		line int
+		ok   bool
+	}{
+		"first":        {ip: 0, line: 1, ok: true},
+		"operand":      {ip: 2, line: 1, ok: true},
+		"exact":        {ip: 3, line: 2, ok: true},
+		"after_last":   {ip: 10, line: 3, ok: true},
+		"before_first": {ip: -1, ok: false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := table.Lookup(tc.ip)
+			if ok != tc.ok || (ok && got.Start.Line != tc.line) {
+				t.Errorf("Lookup(%d) = %v, %t, want line %d, %t", tc.ip, got, ok, tc.line, tc.ok)
+			}
+		})
+	}
+}
+
+func TestLineTable(t *testing.T) {
+	table := PositionTable{
+		{Offset: 0, Span: token.Span{Start: token.Pos{Line: 1, Column: 5, Offset: 4}, End: token.Pos{Line: 1, Column: 9, Offset: 8}}},
+		{Offset: 1, Span: token.Span{Start: token.Pos{Line: 1, Column: 1, Offset: 0}, End: token.Pos{Line: 3, Column: 2, Offset: 30}}},
+		{Offset: 300, Span: token.Span{Start: token.Pos{Line: 12, Column: 3, Offset: 150}, End: token.Pos{Line: 12, Column: 8, Offset: 155}}},
+	}
+
+	packed := table.Pack()
+	if len(packed) != 3*7+2 {
+		t.Errorf("expected small deltas to take a byte each, got %d bytes", len(packed))
+	}
+
+	unpacked, err := packed.Unpack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(table, unpacked) {
+		t.Errorf("round trip changed the table: %v, got %v", table, unpacked)
+	}
+
+	if _, err := packed[:len(packed)-1].Unpack(); err == nil {
+		t.Errorf("expected an error for a truncated table")
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	source := "let a = 1;\n\na + 2"
+	ins := NewBuilder().
+		Add(OpConstant, 0).
+		Add(OpSetGlobal, 0).
+		Add(OpGetGlobal, 0).
+		Add(OpConstant, 1).
+		Add(OpAdd).
+		Add(OpPop).
+		Build()
+
+	line := func(l int) token.Span {
+		return token.Span{Start: token.Pos{Line: l, Column: 1, Offset: (l - 1) * 6}}
+	}
+	positions := PositionTable{{Offset: 0, Span: line(1)}, {Offset: 6, Span: line(3)}}
+
+	expected := `   1 | let a = 1;
+0000 OpConstant 0
+0003 OpSetGlobal 0
+   3 | a + 2
+0006 OpGetGlobal 0
+0009 OpConstant 1
+0012 OpAdd
+0013 OpPop
+`
+	if got := Disassemble(ins, positions, source); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	if got := Disassemble(ins[:2], nil, ""); got != "0000 ERROR: truncated OpConstant\n" {
+		t.Errorf("unexpected output for truncated instructions: %q", got)
+	}
+
+	if got := Disassemble(Instructions{255}, nil, ""); got != "0000 ERROR: unknown opcode 0xff\n" {
+		t.Errorf("unexpected output for unknown opcode: %q", got)
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	listing := `
+; counts down from two
+.const two 2
+.const "done\n" ; strings are quoted
+.const -1
+
+start:
+	OpConstant two
+loop:   OpJumpNotTruthy end
+	OpConstant 2
+	OpJump loop ; back edge
+end:
+0012 OpConstant 1
+	OpClosure 3 255
+`
+	asm, err := Assemble(listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := NewBuilder().
+		Add(OpConstant, 0).
+		Add(OpJumpNotTruthy, 12).
+		Add(OpConstant, 2).
+		Add(OpJump, 3).
+		Add(OpConstant, 1).
+		Add(OpClosure, 3, 255).
+		Build()
+	if !reflect.DeepEqual(expected, asm.Instructions) {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, asm.Instructions)
+	}
+
+	if constants := []interface{}{int64(2), "done\n", int64(-1)}; !reflect.DeepEqual(constants, asm.Constants) {
+		t.Errorf("expected constants %v, got %v", constants, asm.Constants)
+	}
+}
+
+func TestAssembleRoundTrip(t *testing.T) {
+	ins := NewBuilder().
+		Add(OpTrue).
+		Add(OpJumpNotTruthy, 10).
+		Add(OpConstant, 65535).
+		Add(OpJump, 11).
+		Add(OpNull).
+		Add(OpGetLocal, 3).
+		Add(OpPop).
+		Build()
+	positions := PositionTable{{Offset: 0, Span: token.Span{Start: token.Pos{Line: 1, Column: 1}}}}
+
+	for name, listing := range map[string]string{
+		"string":      ins.String(),
+		"disassemble": Disassemble(ins, positions, "if (true) { 1 }"),
+	} {
+		asm, err := Assemble(listing)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if !reflect.DeepEqual(ins, asm.Instructions) {
+			t.Errorf("%s: round trip changed the instructions:\n%s", name, asm.Instructions)
+		}
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := map[string]struct {
+		listing string
+		err     string
+	}{
+		"unknown_instruction": {"OpNope", "line 1: unknown instruction OpNope"},
+		"missing_operand":     {"OpConstant", "line 1: OpConstant takes 1 operands, got 0"},
+		"extra_operand":       {"OpPop 1", "line 1: OpPop takes 0 operands, got 1"},
+		"operand_too_large":   {"OpGetLocal 256", "line 1: operand 256 of OpGetLocal out of range, at most 255 is allowed"},
+		"negative_operand":    {"OpJump -1", "line 1: operand -1 of OpJump out of range, at most 65535 is allowed"},
+		"undefined_label":     {"OpPop\nOpJump nowhere", "line 2: undefined name nowhere"},
+		"duplicate_label":     {"a:\nOpPop\na:", "line 3: a is already defined"},
+		"label_clashes_const": {".const a 1\na: OpPop", "line 2: a is already defined"},
+		"wrong_offset":        {"OpPop\n0002 OpPop", "line 2: listed offset 0002, but instruction is at 0001"},
+		"invalid_constant":    {".const x", `line 1: invalid constant "x"`},
+		"invalid_string":      {`.const "abc`, `line 1: invalid string constant "abc`},
+		"invalid_operand":     {"OpJump 1x", "line 1: invalid operand 1x"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Assemble(tc.listing)
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package code
+
+import (
+	"fmt"
+	"lang_vm/token"
+	"strings"
+)
+
+// Disassemble lists ins one instruction per line. When positions are given,
+// the source line an instruction was compiled from is printed above it
+// whenever it differs from the line of the previous instruction.
+func Disassemble(ins Instructions, positions PositionTable, source string) string {
+	var out strings.Builder
+
+	line := 0
+	for i := 0; i < len(ins); {
+		if span, ok := positions.Lookup(i); ok && span.Start.Line != line {
+			line = span.Start.Line
+			if text, ok := token.SourceLine(source, span.Start); ok {
+				fmt.Fprintf(&out, "%4d | %s\n", line, text)
+			}
+		}
+
+		def, err := Lookup(ins[i])
+		if err != nil {
+			// the length of an unknown instruction is unknown, so is
+			// everything after it
+			fmt.Fprintf(&out, "%04d ERROR: %s\n", i, err)
+			break
+		}
+
+		if i+1+def.OperandsWidth() > len(ins) {
+			fmt.Fprintf(&out, "%04d ERROR: truncated %s\n", i, def.Name)
+			break
+		}
+
+		operands, read := ReadOperands(def, ins[i+1:])
+		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
+
+		i += 1 + read
+	}
+
+	return out.String()
+}
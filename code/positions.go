@@ -0,0 +1,92 @@
+package code
+
+import (
+	"encoding/binary"
+	"fmt"
+	"lang_vm/token"
+	"sort"
+)
+
+// Position attributes the instruction starting at Offset to the source
+// span it was compiled from.
+type Position struct {
+	Offset int
+	Span   token.Span
+}
+
+// PositionTable maps instruction offsets back to source spans. Entries are
+// sorted by Offset; an entry covers all instructions up to the next one, so
+// runs of instructions compiled from the same node share a single entry.
+type PositionTable []Position
+
+// Lookup returns the span of the instruction that ip points into.
+func (t PositionTable) Lookup(ip int) (token.Span, bool) {
+	i := sort.Search(len(t), func(i int) bool { return t[i].Offset > ip })
+	if i == 0 {
+		return token.Span{}, false
+	}
+
+	return t[i-1].Span, true
+}
+
+// LineTable is the packed form of a PositionTable, used to store positions
+// alongside byte code. Each entry is seven varints: the instruction offset,
+// the start offset, line and column as deltas from the previous entry, then
+// the span's length in bytes and lines and its end column.
+type LineTable []byte
+
+// Pack encodes the table. Entries must be sorted by Offset.
+func (t PositionTable) Pack() LineTable {
+	var out []byte
+	var prev Position
+
+	for _, p := range t {
+		out = binary.AppendVarint(out, int64(p.Offset-prev.Offset))
+		out = binary.AppendVarint(out, int64(p.Span.Start.Offset-prev.Span.Start.Offset))
+		out = binary.AppendVarint(out, int64(p.Span.Start.Line-prev.Span.Start.Line))
+		out = binary.AppendVarint(out, int64(p.Span.Start.Column-prev.Span.Start.Column))
+		out = binary.AppendVarint(out, int64(p.Span.End.Offset-p.Span.Start.Offset))
+		out = binary.AppendVarint(out, int64(p.Span.End.Line-p.Span.Start.Line))
+		out = binary.AppendVarint(out, int64(p.Span.End.Column))
+
+		prev = p
+	}
+
+	return out
+}
+
+// Unpack decodes the table.
+func (lt LineTable) Unpack() (PositionTable, error) {
+	table := PositionTable{}
+	var prev Position
+
+	for i := 0; i < len(lt); {
+		var fields [7]int64
+		for f := range fields {
+			var n int
+			fields[f], n = binary.Varint(lt[i:])
+			if n <= 0 {
+				return nil, fmt.Errorf("malformed line table at byte %d", i)
+			}
+			i += n
+		}
+
+		var p Position
+		p.Offset = prev.Offset + int(fields[0])
+		p.Span.Start = token.Pos{
+			Offset: prev.Span.Start.Offset + int(fields[1]),
+			Line:   prev.Span.Start.Line + int(fields[2]),
+			Column: prev.Span.Start.Column + int(fields[3]),
+		}
+		p.Span.End = token.Pos{
+			Offset: p.Span.Start.Offset + int(fields[4]),
+			Line:   p.Span.Start.Line + int(fields[5]),
+			Column: int(fields[6]),
+		}
+
+		table = append(table, p)
+		prev = p
+	}
+
+	return table, nil
+}
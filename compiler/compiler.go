@@ -1,32 +1,83 @@
 package compiler
 
 import (
-	"fmt"
 	"lang_vm/ast"
 	"lang_vm/code"
 	"lang_vm/object"
+	"lang_vm/token"
+)
+
+const (
+	// maxLocals, maxArguments and maxFree are bounded by the one byte
+	// operands of OpSetLocal, OpGetLocal, OpCall and OpClosure.
+	maxLocals    = 255
+	maxArguments = 255
+	maxFree      = 255
+
+	// maxElements is bounded by the two byte operand of OpArray and OpHash.
+	maxElements = 65535
+
+	// maxConstants and maxJumpTarget are bounded by the two byte operands
+	// of OpConstant, OpClosure and the jumps.
+	maxConstants  = 65536
+	maxJumpTarget = 65535
+
+	// maxGlobals is bounded by the two byte operand of OpSetGlobal and
+	// OpGetGlobal, it matches vm.GlobalsSize.
+	maxGlobals = 65536
 )
 
 type Compiler struct {
 	ins        code.Instructions
+	constants  []object.Object
 	scopes     []CompilationScope
 	scopeIndex int
+
+	symbolTable *SymbolTable
+
+	// node is the innermost node being compiled, emitted instructions are
+	// attributed to its span.
+	node ast.Node
+
+	// constantIndex maps literal constants to their slot in the pool,
+	// so that the same literal is only stored once.
+	constantIndex map[constantKey]int
+}
+
+type constantKey struct {
+	t     object.Type
+	value string
 }
 
 type ByteCode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+
+	// Positions is the source map of Instructions, Positions.Pack() gives
+	// its compact encoding.
+	Positions code.PositionTable
 }
 
 type CompilationScope struct {
-	ins code.Instructions
+	ins                 code.Instructions
+	positions           code.PositionTable
+	lastInstruction     EmittedInstruction
+	previousInstruction EmittedInstruction
+}
+
+type EmittedInstruction struct {
+	OpCode   code.OpCode
+	Position int
 }
 
 func NewCompiler() *Compiler {
 	c := &Compiler{
-		ins:        code.Instructions{},
-		scopes:     make([]CompilationScope, 0),
-		scopeIndex: 0,
+		ins:           code.Instructions{},
+		constants:     []object.Object{},
+		scopes:        make([]CompilationScope, 0),
+		scopeIndex:    0,
+		constantIndex: make(map[constantKey]int),
+		symbolTable:   NewSymbolTable(),
 	}
 
 	c.scopes = append(c.scopes, CompilationScope{ins: code.Instructions{}})
@@ -34,47 +85,222 @@ func NewCompiler() *Compiler {
 	return c
 }
 
+// NewWithState returns a compiler that continues from the symbol table and
+// constant pool of an earlier compilation, so that successive inputs (e.g.
+// REPL lines) can refer to each other's globals.
+func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
+	c := NewCompiler()
+	c.symbolTable = s
+	c.constants = constants
+
+	for i, constant := range constants {
+		if key, dedup := constantKeyOf(constant); dedup {
+			if _, ok := c.constantIndex[key]; !ok {
+				c.constantIndex[key] = i
+			}
+		}
+	}
+
+	return c
+}
+
 func (c *Compiler) Compile(node ast.Node) error {
+	outer := c.node
+	c.node = node
+	defer func() { c.node = outer }()
+
 	switch n := node.(type) {
 	case *ast.Program:
-		for _, stmt := range n.Statements {
-			if err := c.Compile(stmt); err != nil {
-				return err
-			}
-		}
+		return c.compileStatements(n.Statements)
 
 	case *ast.BlockStatement:
-		for _, stmt := range n.Statements {
-			if err := c.Compile(stmt); err != nil {
+		return c.compileStatements(n.Statements)
+
+	case *ast.ExpressionStatement:
+		if err := c.Compile(n.Expression); err != nil {
+			return err
+		}
+		c.emit(code.OpPop)
+
+	case *ast.LetStatement:
+		if err := c.Compile(n.Value); err != nil {
+			// define the name regardless, so that its uses aren't
+			// reported as well
+			c.symbolTable.Define(n.Name.Value)
+			return err
+		}
+
+		symbol := c.symbolTable.Define(n.Name.Value)
+		if err := c.checkGlobal(symbol); err != nil {
+			return err
+		}
+		c.storeSymbol(symbol)
+
+	case *ast.ReturnStatement:
+		if c.scopeIndex == 0 {
+			return c.errorf(CodeReturnOutsideFunction, "return statement outside of function")
+		}
+
+		if err := c.Compile(n.ReturnValue); err != nil {
+			return err
+		}
+
+		c.emit(code.OpReturnValue)
+
+	case *ast.FunctionLiteral:
+		if err := c.compileFunctionLiteral(*n); err != nil {
+			return err
+		}
+
+	case *ast.CallExpression:
+		if err := c.Compile(n.Function); err != nil {
+			return err
+		}
+
+		for _, arg := range n.Arguments {
+			if err := c.Compile(arg); err != nil {
 				return err
 			}
 		}
 
-	case *ast.ExpressionStatement:
-		if err := c.Compile(n.Expression); err != nil {
+		if len(n.Arguments) > maxArguments {
+			return c.errorf(CodeLimitExceeded, "too many arguments: %d, at most %d are allowed", len(n.Arguments), maxArguments)
+		}
+
+		c.emit(code.OpCall, len(n.Arguments))
+
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(n.Value)
+		if !ok {
+			return c.errorf(CodeUndefinedVariable, "undefined variable %s", n.Value)
+		}
+		// host symbol tables define globals on first use
+		if err := c.checkGlobal(symbol); err != nil {
 			return err
 		}
 
+		c.loadSymbol(symbol)
+
 	case *ast.IfExpression:
 		if err := c.compileIfExpression(*n); err != nil {
 			return err
 		}
 
+	case *ast.PrefixExpression:
+		if err := c.compilePrefixExpression(*n); err != nil {
+			return err
+		}
+
 	case *ast.BinaryExpression:
 		if err := c.compileBinaryExpression(*n); err != nil {
 			return err
 		}
 
 	case *ast.IntegerLiteral:
-		c.emit(code.OpConstant, int(n.Value))
+		integer := &object.Integer{Value: n.Value}
+		idx, err := c.addConstant(integer)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpConstant, idx)
+
+	case *ast.StringLiteral:
+		str := &object.String{Value: n.Value}
+		idx, err := c.addConstant(str)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpConstant, idx)
+
+	case *ast.ArrayLiteral:
+		if len(n.Elements) > maxElements {
+			return c.errorf(CodeLimitExceeded, "too many array elements: %d, at most %d are allowed", len(n.Elements), maxElements)
+		}
+
+		for _, el := range n.Elements {
+			if err := c.Compile(el); err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpArray, len(n.Elements))
+
+	case *ast.HashLiteral:
+		if 2*len(n.Pairs) > maxElements {
+			return c.errorf(CodeLimitExceeded, "too many hash pairs: %d, at most %d are allowed", len(n.Pairs), maxElements/2)
+		}
+
+		for _, pair := range n.Pairs {
+			if err := c.Compile(pair.Key); err != nil {
+				return err
+			}
+
+			if err := c.Compile(pair.Value); err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpHash, 2*len(n.Pairs))
+
+	case *ast.IndexExpression:
+		if err := c.Compile(n.Left); err != nil {
+			return err
+		}
+
+		if err := c.Compile(n.Index); err != nil {
+			return err
+		}
+
+		c.emit(code.OpIndex)
+
+	case *ast.Boolean:
+		if n.Value {
+			c.emit(code.OpTrue)
+		} else {
+			c.emit(code.OpFalse)
+		}
 
 	default:
-		return fmt.Errorf("unknown node type: %T", n)
+		return c.errorf(CodeUnsupported, "unknown node type: %T", n)
+	}
+
+	return nil
+}
+
+// compileStatements compiles every statement, also after errors, and
+// returns the errors of all of them.
+func (c *Compiler) compileStatements(statements []ast.Statement) error {
+	var errs Errors
+	for _, stmt := range statements {
+		if err := c.Compile(stmt); err != nil {
+			errs = appendErrors(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
 	}
 
 	return nil
 }
 
+func (c *Compiler) compilePrefixExpression(n ast.PrefixExpression) error {
+	if err := c.Compile(n.Right); err != nil {
+		return err
+	}
+
+	switch n.Operator {
+	case "-":
+		c.emit(code.OpMinus)
+	case "!":
+		c.emit(code.OpBang)
+
+	default:
+		return c.errorf(CodeUnsupported, "unsupported operator: %s", n.Operator)
+	}
+	return nil
+}
+
 func (c *Compiler) compileBinaryExpression(n ast.BinaryExpression) error {
 	if err := c.Compile(n.Left); err != nil {
 		return err
@@ -99,9 +325,15 @@ func (c *Compiler) compileBinaryExpression(n ast.BinaryExpression) error {
 		c.emit(code.OpNotEqual)
 	case ">":
 		c.emit(code.OpGreaterThan)
+	case ">=":
+		c.emit(code.OpGreaterThanOrEqual)
+	case "<":
+		c.emit(code.OpLessThan)
+	case "<=":
+		c.emit(code.OpLessThanOrEqual)
 
 	default:
-		return fmt.Errorf("unsupported operator: %s", n.Operator)
+		return c.errorf(CodeUnsupported, "unsupported operator: %s", n.Operator)
 	}
 	return nil
 }
@@ -113,31 +345,232 @@ func (c *Compiler) compileIfExpression(n ast.IfExpression) error {
 
 	jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
 
-	if err := c.Compile(n.Consequence); err != nil {
+	if err := c.compileBlockValue(n.Consequence); err != nil {
 		return err
 	}
 
 	jumpPos := c.emit(code.OpJump, 9999)
 
-	afterConsequencePos := len(c.currentInstructions())
-	c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
+	if err := c.patchJump(jumpNotTruthyPos); err != nil {
+		return err
+	}
 
 	if n.Alternative == nil {
 		c.emit(code.OpNull)
 	} else {
-		if err := c.Compile(n.Alternative); err != nil {
+		if err := c.compileBlockValue(n.Alternative); err != nil {
 			return err
 		}
 	}
 
-	afterAlternative := len(c.currentInstructions())
-	c.changeOperand(jumpPos, afterAlternative)
+	return c.patchJump(jumpPos)
+}
+
+// checkGlobal rejects global symbols whose index doesn't fit the operands
+// of OpSetGlobal and OpGetGlobal.
+func (c *Compiler) checkGlobal(symbol Symbol) error {
+	if symbol.Scope == GlobalScope && symbol.Index >= maxGlobals {
+		return c.errorf(CodeLimitExceeded, "too many globals, at most %d are allowed", maxGlobals)
+	}
+
+	return nil
+}
+
+// patchJump points the jump at opPos to the end of the current
+// instructions.
+func (c *Compiler) patchJump(opPos int) error {
+	target := len(c.currentInstructions())
+	if target > maxJumpTarget {
+		return c.errorf(CodeLimitExceeded, "jump target %d out of range, function bodies are limited to %d bytes", target, maxJumpTarget)
+	}
+
+	c.changeOperand(opPos, target)
+	return nil
+}
+
+func (c *Compiler) compileFunctionLiteral(n ast.FunctionLiteral) error {
+	c.enterScope()
+
+	if n.Name != "" {
+		c.symbolTable.DefineFunctionName(n.Name)
+	}
+
+	seen := make(map[string]bool, len(n.Parameters))
+	for _, p := range n.Parameters {
+		// a repeated name would share its slot with the earlier parameter,
+		// leaving fewer locals than parameters
+		if seen[p.Value] {
+			c.leaveScope()
+			err := c.errorf(CodeDuplicateParameter, "duplicate parameter %s", p.Value)
+			err.Span = p.Span()
+			return err
+		}
+		seen[p.Value] = true
+
+		c.symbolTable.Define(p.Value)
+	}
+
+	if err := c.Compile(n.Body); err != nil {
+		c.leaveScope()
+		return err
+	}
+
+	// the value of the last expression statement is the implicit result
+	if c.lastInstructionIs(code.OpPop) {
+		c.replaceLastPopWithReturn()
+	}
+	if !c.lastInstructionIs(code.OpReturnValue) {
+		c.emit(code.OpReturn)
+	}
+
+	freeSymbols := c.symbolTable.FreeSymbols
+	numLocals := c.symbolTable.NumDefinitions()
+	positions := c.scopes[c.scopeIndex].positions
+	ins := c.leaveScope()
+
+	if numLocals > maxLocals {
+		return c.errorf(CodeLimitExceeded, "too many local variables: %d, at most %d are allowed", numLocals, maxLocals)
+	}
+	if len(freeSymbols) > maxFree {
+		return c.errorf(CodeLimitExceeded, "too many captured variables: %d, at most %d are allowed", len(freeSymbols), maxFree)
+	}
+
+	// push the captured values, OpClosure moves them into the closure
+	for _, s := range freeSymbols {
+		c.loadSymbol(s)
+	}
+
+	fn := &object.CompiledFunction{
+		Instructions:  ins,
+		NumLocals:     numLocals,
+		NumParameters: len(n.Parameters),
+		Name:          n.Name,
+		Positions:     positions,
+	}
+	idx, err := c.addConstant(fn)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpClosure, idx, len(freeSymbols))
+
+	return nil
+}
+
+// addConstant stores obj in the constant pool and returns its index.
+// Literals that are already in the pool are reused.
+func (c *Compiler) addConstant(obj object.Object) (int, error) {
+	key, dedup := constantKeyOf(obj)
+	if dedup {
+		if idx, ok := c.constantIndex[key]; ok {
+			return idx, nil
+		}
+	}
+
+	if len(c.constants) >= maxConstants {
+		return 0, c.errorf(CodeLimitExceeded, "too many constants, at most %d are allowed", maxConstants)
+	}
+
+	c.constants = append(c.constants, obj)
+	idx := len(c.constants) - 1
+
+	if dedup {
+		c.constantIndex[key] = idx
+	}
+
+	return idx, nil
+}
+
+func constantKeyOf(obj object.Object) (constantKey, bool) {
+	switch obj.(type) {
+	case *object.Integer, *object.String:
+		return constantKey{t: obj.Type(), value: obj.Inspect()}, true
+	}
+
+	return constantKey{}, false
+}
+
+func (c *Compiler) storeSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpSetLocal, s.Index)
+	}
+}
+
+func (c *Compiler) loadSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpGetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpGetLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpGetFree, s.Index)
+	case FunctionScope:
+		c.emit(code.OpCurrentClosure)
+	case BuiltinScope:
+		c.emit(code.OpGetBuiltin, s.Index)
+	}
+}
+
+// compileBlockValue compiles a block whose last expression is the value of
+// the enclosing expression, so the trailing OpPop is dropped. Blocks that
+// produce no value leave null on the stack instead.
+func (c *Compiler) compileBlockValue(block *ast.BlockStatement) error {
+	start := len(c.currentInstructions())
+	if err := c.Compile(block); err != nil {
+		return err
+	}
+
+	if len(c.currentInstructions()) > start && c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+
 	return nil
 }
 
 func (c *Compiler) emit(op code.OpCode, operands ...int) int {
 	ins := code.Make(op, operands...)
-	return c.addInstruction(ins)
+	pos := c.addInstruction(ins)
+
+	c.setLastInstruction(op, pos)
+
+	return pos
+}
+
+func (c *Compiler) setLastInstruction(op code.OpCode, pos int) {
+	scope := &c.scopes[c.scopeIndex]
+
+	scope.previousInstruction = scope.lastInstruction
+	scope.lastInstruction = EmittedInstruction{OpCode: op, Position: pos}
+}
+
+func (c *Compiler) lastInstructionIs(op code.OpCode) bool {
+	if len(c.currentInstructions()) == 0 {
+		return false
+	}
+
+	return c.scopes[c.scopeIndex].lastInstruction.OpCode == op
+}
+
+func (c *Compiler) replaceLastPopWithReturn() {
+	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
+	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
+
+	c.scopes[c.scopeIndex].lastInstruction.OpCode = code.OpReturnValue
+}
+
+func (c *Compiler) removeLastPop() {
+	scope := &c.scopes[c.scopeIndex]
+
+	scope.ins = scope.ins[:scope.lastInstruction.Position]
+	scope.lastInstruction = scope.previousInstruction
+
+	for len(scope.positions) > 0 && scope.positions[len(scope.positions)-1].Offset >= len(scope.ins) {
+		scope.positions = scope.positions[:len(scope.positions)-1]
+	}
 }
 
 func (c *Compiler) addInstruction(ins []byte) int {
@@ -146,9 +579,25 @@ func (c *Compiler) addInstruction(ins []byte) int {
 	updatedInstructions := append(c.currentInstructions(), ins...)
 	c.scopes[c.scopeIndex].ins = updatedInstructions
 
+	if c.node != nil {
+		c.addPosition(posNewInstruction, c.node.Span())
+	}
+
 	return posNewInstruction
 }
 
+// addPosition attributes the instruction at pos to span. An instruction
+// compiled from the same node as the one before it needs no entry of its own.
+func (c *Compiler) addPosition(pos int, span token.Span) {
+	scope := &c.scopes[c.scopeIndex]
+
+	if n := len(scope.positions); n > 0 && scope.positions[n-1].Span == span {
+		return
+	}
+
+	scope.positions = append(scope.positions, code.Position{Offset: pos, Span: span})
+}
+
 func (c *Compiler) currentInstructions() code.Instructions {
 	return c.scopes[c.scopeIndex].ins
 }
@@ -168,9 +617,39 @@ func (c *Compiler) changeOperand(opPos int, operand int) {
 	c.replaceInstruction(opPos, newInstruction)
 }
 
+// enterScope starts compiling into a fresh instruction sequence with its
+// own local symbol table.
+func (c *Compiler) enterScope() {
+	c.scopes = append(c.scopes, CompilationScope{ins: code.Instructions{}})
+	c.scopeIndex++
+
+	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
+}
+
+// leaveScope returns the instructions of the innermost scope and resumes
+// compiling into the enclosing one.
+func (c *Compiler) leaveScope() code.Instructions {
+	ins := c.currentInstructions()
+
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.scopeIndex--
+
+	c.symbolTable = c.symbolTable.Outer
+
+	return ins
+}
+
+// SymbolTable returns the global symbol table, which can be handed to
+// NewWithState for a follow-up compilation.
+func (c *Compiler) SymbolTable() *SymbolTable {
+	return c.symbolTable
+}
+
 func (c *Compiler) ByteCode() *ByteCode {
 	b := &ByteCode{
 		Instructions: c.currentInstructions(),
+		Constants:    c.constants,
+		Positions:    c.scopes[c.scopeIndex].positions,
 	}
 
 	return b
@@ -1,41 +1,459 @@
 package compiler
 
 import (
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/assert"
 	"lang_vm/code"
 	"lang_vm/lexer"
+	"lang_vm/object"
 	"lang_vm/parser"
+	"strings"
 	"testing"
 )
 
 func TestCompilerByteCode(t *testing.T) {
 	tests := map[string]struct {
-		code     string
-		byteCode code.Instructions
+		code      string
+		byteCode  code.Instructions
+		constants []object.Object
 	}{
 		"simple_addition": {
 			code: "2 + 5",
 			byteCode: code.NewBuilder().
-				Add(code.OpConstant, 2).
-				Add(code.OpConstant, 5).
+				Add(code.OpConstant, 0).
+				Add(code.OpConstant, 1).
 				Add(code.OpAdd).
+				Add(code.OpPop).
 				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 2},
+				&object.Integer{Value: 5},
+			},
 		},
 		"multiple_statements": {
 			code: `2 + 5;
 					5 - 5; 
 					45 / 54; `,
 			byteCode: code.NewBuilder().
-				Add(code.OpConstant, 2).
-				Add(code.OpConstant, 5).
+				Add(code.OpConstant, 0).
+				Add(code.OpConstant, 1).
 				Add(code.OpAdd).
-				Add(code.OpConstant, 5).
-				Add(code.OpConstant, 5).
+				Add(code.OpPop).
+				Add(code.OpConstant, 1).
+				Add(code.OpConstant, 1).
 				Add(code.OpSub).
-				Add(code.OpConstant, 45).
-				Add(code.OpConstant, 54).
+				Add(code.OpPop).
+				Add(code.OpConstant, 2).
+				Add(code.OpConstant, 3).
 				Add(code.OpDiv).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 2},
+				&object.Integer{Value: 5},
+				&object.Integer{Value: 45},
+				&object.Integer{Value: 54},
+			},
+		},
+		"large_literal": {
+			code: "70000 + 70000",
+			byteCode: code.NewBuilder().
+				Add(code.OpConstant, 0).
+				Add(code.OpConstant, 0).
+				Add(code.OpAdd).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 70000},
+			},
+		},
+		"booleans": {
+			code: "true; false",
+			byteCode: code.NewBuilder().
+				Add(code.OpTrue).
+				Add(code.OpPop).
+				Add(code.OpFalse).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{},
+		},
+		"prefix_operators": {
+			code: "-1; !true",
+			byteCode: code.NewBuilder().
+				Add(code.OpConstant, 0).
+				Add(code.OpMinus).
+				Add(code.OpPop).
+				Add(code.OpTrue).
+				Add(code.OpBang).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 1},
+			},
+		},
+		"comparisons": {
+			code: "1 > 2; 1 >= 2; 1 < 2; 1 <= 2; 1 == 2; 1 != 2",
+			byteCode: code.NewBuilder().
+				Add(code.OpConstant, 0).Add(code.OpConstant, 1).Add(code.OpGreaterThan).Add(code.OpPop).
+				Add(code.OpConstant, 0).Add(code.OpConstant, 1).Add(code.OpGreaterThanOrEqual).Add(code.OpPop).
+				Add(code.OpConstant, 0).Add(code.OpConstant, 1).Add(code.OpLessThan).Add(code.OpPop).
+				Add(code.OpConstant, 0).Add(code.OpConstant, 1).Add(code.OpLessThanOrEqual).Add(code.OpPop).
+				Add(code.OpConstant, 0).Add(code.OpConstant, 1).Add(code.OpEqual).Add(code.OpPop).
+				Add(code.OpConstant, 0).Add(code.OpConstant, 1).Add(code.OpNotEqual).Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 2},
+			},
+		},
+		"strings": {
+			code: `"mon" + "key"; "mon"`,
+			byteCode: code.NewBuilder().
+				Add(code.OpConstant, 0).
+				Add(code.OpConstant, 1).
+				Add(code.OpAdd).
+				Add(code.OpPop).
+				Add(code.OpConstant, 0).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.String{Value: "mon"},
+				&object.String{Value: "key"},
+			},
+		},
+		"strings_and_integers_not_merged": {
+			code: `"1"; 1`,
+			byteCode: code.NewBuilder().
+				Add(code.OpConstant, 0).
+				Add(code.OpPop).
+				Add(code.OpConstant, 1).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.String{Value: "1"},
+				&object.Integer{Value: 1},
+			},
+		},
+		"arrays": {
+			code: "[]; [1, 2 + 3]",
+			byteCode: code.NewBuilder().
+				Add(code.OpArray, 0).
+				Add(code.OpPop).
+				Add(code.OpConstant, 0).
+				Add(code.OpConstant, 1).
+				Add(code.OpConstant, 2).
+				Add(code.OpAdd).
+				Add(code.OpArray, 2).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 2},
+				&object.Integer{Value: 3},
+			},
+		},
+		"index_expression": {
+			code: "[1, 2][1 + 1]",
+			byteCode: code.NewBuilder().
+				Add(code.OpConstant, 0).
+				Add(code.OpConstant, 1).
+				Add(code.OpArray, 2).
+				Add(code.OpConstant, 0).
+				Add(code.OpConstant, 0).
+				Add(code.OpAdd).
+				Add(code.OpIndex).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 2},
+			},
+		},
+		"hashes": {
+			code: `{}; {"a": 1, 2: 3 * 4}["a"]`,
+			byteCode: code.NewBuilder().
+				Add(code.OpHash, 0).
+				Add(code.OpPop).
+				Add(code.OpConstant, 0).
+				Add(code.OpConstant, 1).
+				Add(code.OpConstant, 2).
+				Add(code.OpConstant, 3).
+				Add(code.OpConstant, 4).
+				Add(code.OpMul).
+				Add(code.OpHash, 4).
+				Add(code.OpConstant, 0).
+				Add(code.OpIndex).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.String{Value: "a"},
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 2},
+				&object.Integer{Value: 3},
+				&object.Integer{Value: 4},
+			},
+		},
+		"builtins": {
+			code: "len([]); fn() { push([], 1) }",
+			byteCode: code.NewBuilder().
+				Add(code.OpGetBuiltin, 0).
+				Add(code.OpArray, 0).
+				Add(code.OpCall, 1).
+				Add(code.OpPop).
+				Add(code.OpClosure, 1, 0).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.CompiledFunction{
+					Instructions: code.NewBuilder().
+						Add(code.OpGetBuiltin, 5).
+						Add(code.OpArray, 0).
+						Add(code.OpConstant, 0).
+						Add(code.OpCall, 2).
+						Add(code.OpReturnValue).
+						Build(),
+				},
+			},
+		},
+		"global_let_statements": {
+			code: "let one = 1; let two = 2; one + two",
+			byteCode: code.NewBuilder().
+				Add(code.OpConstant, 0).
+				Add(code.OpSetGlobal, 0).
+				Add(code.OpConstant, 1).
+				Add(code.OpSetGlobal, 1).
+				Add(code.OpGetGlobal, 0).
+				Add(code.OpGetGlobal, 1).
+				Add(code.OpAdd).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 2},
+			},
+		},
+		"function_implicit_return": {
+			code: "fn() { 5 + 10 }",
+			byteCode: code.NewBuilder().
+				Add(code.OpClosure, 2, 0).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 5},
+				&object.Integer{Value: 10},
+				&object.CompiledFunction{
+					Instructions: code.NewBuilder().
+						Add(code.OpConstant, 0).
+						Add(code.OpConstant, 1).
+						Add(code.OpAdd).
+						Add(code.OpReturnValue).
+						Build(),
+				},
+			},
+		},
+		"function_explicit_return": {
+			code: "fn() { return 5; 10 }",
+			byteCode: code.NewBuilder().
+				Add(code.OpClosure, 2, 0).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 5},
+				&object.Integer{Value: 10},
+				&object.CompiledFunction{
+					Instructions: code.NewBuilder().
+						Add(code.OpConstant, 0).
+						Add(code.OpReturnValue).
+						Add(code.OpConstant, 1).
+						Add(code.OpReturnValue).
+						Build(),
+				},
+			},
+		},
+		"function_empty_body": {
+			code: "fn() { }",
+			byteCode: code.NewBuilder().
+				Add(code.OpClosure, 0, 0).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.CompiledFunction{
+					Instructions: code.NewBuilder().
+						Add(code.OpReturn).
+						Build(),
+				},
+			},
+		},
+		"function_locals_and_call": {
+			code: "let g = 1; let f = fn(a, b) { let c = a + b; c + g }; f(2, 3);",
+			byteCode: code.NewBuilder().
+				Add(code.OpConstant, 0).
+				Add(code.OpSetGlobal, 0).
+				Add(code.OpClosure, 1, 0).
+				Add(code.OpSetGlobal, 1).
+				Add(code.OpGetGlobal, 1).
+				Add(code.OpConstant, 2).
+				Add(code.OpConstant, 3).
+				Add(code.OpCall, 2).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.CompiledFunction{
+					Instructions: code.NewBuilder().
+						Add(code.OpGetLocal, 0).
+						Add(code.OpGetLocal, 1).
+						Add(code.OpAdd).
+						Add(code.OpSetLocal, 2).
+						Add(code.OpGetLocal, 2).
+						Add(code.OpGetGlobal, 0).
+						Add(code.OpAdd).
+						Add(code.OpReturnValue).
+						Build(),
+					NumLocals:     3,
+					NumParameters: 2,
+					Name:          "f",
+				},
+				&object.Integer{Value: 2},
+				&object.Integer{Value: 3},
+			},
+		},
+		"closure_free_variables": {
+			code: "fn(a) { fn(b) { fn(c) { a + b + c } } }",
+			byteCode: code.NewBuilder().
+				Add(code.OpClosure, 2, 0).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.CompiledFunction{
+					Instructions: code.NewBuilder().
+						Add(code.OpGetFree, 0).
+						Add(code.OpGetFree, 1).
+						Add(code.OpAdd).
+						Add(code.OpGetLocal, 0).
+						Add(code.OpAdd).
+						Add(code.OpReturnValue).
+						Build(),
+					NumLocals:     1,
+					NumParameters: 1,
+				},
+				&object.CompiledFunction{
+					Instructions: code.NewBuilder().
+						Add(code.OpGetFree, 0).
+						Add(code.OpGetLocal, 0).
+						Add(code.OpClosure, 0, 2).
+						Add(code.OpReturnValue).
+						Build(),
+					NumLocals:     1,
+					NumParameters: 1,
+				},
+				&object.CompiledFunction{
+					Instructions: code.NewBuilder().
+						Add(code.OpGetLocal, 0).
+						Add(code.OpClosure, 1, 1).
+						Add(code.OpReturnValue).
+						Build(),
+					NumLocals:     1,
+					NumParameters: 1,
+				},
+			},
+		},
+		"closure_recursive": {
+			code: "let countDown = fn(x) { countDown(x - 1); }; countDown(1);",
+			byteCode: code.NewBuilder().
+				Add(code.OpClosure, 1, 0).
+				Add(code.OpSetGlobal, 0).
+				Add(code.OpGetGlobal, 0).
+				Add(code.OpConstant, 0).
+				Add(code.OpCall, 1).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.CompiledFunction{
+					Instructions: code.NewBuilder().
+						Add(code.OpCurrentClosure).
+						Add(code.OpGetLocal, 0).
+						Add(code.OpConstant, 0).
+						Add(code.OpSub).
+						Add(code.OpCall, 1).
+						Add(code.OpReturnValue).
+						Build(),
+					NumLocals:     1,
+					NumParameters: 1,
+					Name:          "countDown",
+				},
+			},
+		},
+		"if_without_else": {
+			code: "if (1) { 10 }; 3333;",
+			byteCode: code.NewBuilder().
+				// 0000
+				Add(code.OpConstant, 0).
+				// 0003
+				Add(code.OpJumpNotTruthy, 12).
+				// 0006
+				Add(code.OpConstant, 1).
+				// 0009
+				Add(code.OpJump, 13).
+				// 0012
+				Add(code.OpNull).
+				// 0013
+				Add(code.OpPop).
+				// 0014
+				Add(code.OpConstant, 2).
+				// 0017
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 10},
+				&object.Integer{Value: 3333},
+			},
+		},
+		"if_with_else": {
+			code: "if (1) { 10 } else { 20; 30 }",
+			byteCode: code.NewBuilder().
+				// 0000
+				Add(code.OpConstant, 0).
+				// 0003
+				Add(code.OpJumpNotTruthy, 12).
+				// 0006
+				Add(code.OpConstant, 1).
+				// 0009
+				Add(code.OpJump, 19).
+				// 0012
+				Add(code.OpConstant, 2).
+				// 0015
+				Add(code.OpPop).
+				// 0016
+				Add(code.OpConstant, 3).
+				// 0019
+				Add(code.OpPop).
 				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 1},
+				&object.Integer{Value: 10},
+				&object.Integer{Value: 20},
+				&object.Integer{Value: 30},
+			},
+		},
+		"if_with_empty_block": {
+			code: "if (1) { }",
+			byteCode: code.NewBuilder().
+				Add(code.OpConstant, 0).
+				Add(code.OpJumpNotTruthy, 10).
+				Add(code.OpNull).
+				Add(code.OpJump, 11).
+				Add(code.OpNull).
+				Add(code.OpPop).
+				Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 1},
+			},
 		},
 	}
 
@@ -49,6 +467,210 @@ func TestCompilerByteCode(t *testing.T) {
 			err := c.Compile(program)
 			assert.NoError(t, err)
 			assert.Equal(t, tc.byteCode, c.ByteCode().Instructions)
+
+			// positions are covered by TestCompilerPositions
+			ignorePositions := cmpopts.IgnoreFields(object.CompiledFunction{}, "Positions")
+			if diff := cmp.Diff(tc.constants, c.ByteCode().Constants, ignorePositions); diff != "" {
+				t.Errorf("constants mismatch (-want +got):\n%s", diff)
+			}
 		})
 	}
 }
+
+func TestCompilerErrors(t *testing.T) {
+	tests := map[string]struct {
+		code string
+		err  string
+	}{
+		"undefined_variable": {code: "let a = b;", err: "undefined variable b"},
+		"local_out_of_scope": {code: "let f = fn() { let x = 1; }; x", err: "undefined variable x"},
+		"top_level_return":   {code: "return 1;", err: "return statement outside of function"},
+		"self_reference":     {code: "let x = x + 1;", err: "undefined variable x"},
+		"duplicate_param":    {code: "let t = fn(a, b, a) { a }; t(1, 2, 3);", err: "duplicate parameter a"},
+		"too_many_constants": {code: numbers(maxConstants + 1), err: "too many constants, at most 65536 are allowed"},
+		"too_many_globals":   {code: lets(maxGlobals + 1), err: "too many globals, at most 65536 are allowed"},
+		"jump_out_of_range": {
+			// every "1;" compiles to OpConstant and OpPop, four bytes
+			code: "if (true) { " + strings.Repeat("1; ", 16384) + "}",
+			err:  "jump target 65542 out of range, function bodies are limited to 65535 bytes",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			l := lexer.New(tc.code)
+			p := parser.New(l)
+			program := p.ParseProgram()
+
+			c := NewCompiler()
+			assert.EqualError(t, c.Compile(program), tc.err)
+		})
+	}
+}
+
+func TestCompilerErrorLocations(t *testing.T) {
+	input := "let a = b;\nlet f = fn() {\n  if (a) { return c; }\n};\nreturn a;\nf(a)"
+
+	c := NewCompiler()
+	err := c.Compile(parser.New(lexer.New(input)).ParseProgram())
+
+	var errs Errors
+	assert.ErrorAs(t, err, &errs)
+	assert.EqualError(t, err, "undefined variable b; undefined variable c; return statement outside of function")
+
+	var got []string
+	for _, d := range errs.Diagnostics() {
+		got = append(got, d.String())
+	}
+	assert.Equal(t, []string{
+		"1:9: error[C001]: undefined variable b",
+		"3:19: error[C001]: undefined variable c",
+		"5:1: error[C002]: return statement outside of function",
+	}, got)
+}
+
+// numbers returns a program using n distinct integer literals.
+func numbers(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "%d;", i)
+	}
+
+	return b.String()
+}
+
+// lets returns a program defining n globals, named by name.
+func lets(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "let %s = 1;", name(i))
+	}
+
+	return b.String()
+}
+
+// name returns a distinct identifier for every i. Identifiers can't
+// contain digits, the prefix keeps them clear of keywords.
+func name(i int) string {
+	s := ""
+	for {
+		s = string(rune('a'+i%26)) + s
+		i /= 26
+		if i == 0 {
+			return "v" + s
+		}
+	}
+}
+
+func TestCompilerGlobalLimit(t *testing.T) {
+	program := parser.New(lexer.New(lets(maxGlobals) + "va")).ParseProgram()
+	assert.NoError(t, NewCompiler().Compile(program))
+
+	symbols := NewHostSymbolTable()
+	for i := 0; i < maxGlobals; i++ {
+		symbols.Define(name(i))
+	}
+	program = parser.New(lexer.New("zzzzz")).ParseProgram()
+	assert.EqualError(t, NewWithState(symbols, []object.Object{}).Compile(program), "too many globals, at most 65536 are allowed")
+}
+
+func TestCompilerConstantLimit(t *testing.T) {
+	program := parser.New(lexer.New(numbers(maxConstants))).ParseProgram()
+
+	c := NewCompiler()
+	assert.NoError(t, c.Compile(program))
+	assert.Len(t, c.ByteCode().Constants, maxConstants)
+}
+
+func TestCompilerWithState(t *testing.T) {
+	first := NewCompiler()
+	assert.NoError(t, first.Compile(parser.New(lexer.New("let a = 7;")).ParseProgram()))
+
+	second := NewWithState(first.SymbolTable(), first.ByteCode().Constants)
+	assert.NoError(t, second.Compile(parser.New(lexer.New("a + 7")).ParseProgram()))
+
+	assert.Equal(t, code.NewBuilder().
+		Add(code.OpGetGlobal, 0).
+		Add(code.OpConstant, 0).
+		Add(code.OpAdd).
+		Add(code.OpPop).
+		Build(), second.ByteCode().Instructions)
+	assert.Equal(t, []object.Object{&object.Integer{Value: 7}}, second.ByteCode().Constants)
+}
+
+func TestCompilerScopes(t *testing.T) {
+	c := NewCompiler()
+	global := c.symbolTable
+
+	c.emit(code.OpMul)
+
+	c.enterScope()
+	assert.Equal(t, 1, c.scopeIndex)
+	assert.Equal(t, global, c.symbolTable.Outer)
+
+	c.emit(code.OpSub)
+	assert.Equal(t, code.NewBuilder().Add(code.OpSub).Build(), c.currentInstructions())
+
+	ins := c.leaveScope()
+	assert.Equal(t, code.NewBuilder().Add(code.OpSub).Build(), ins)
+	assert.Equal(t, 0, c.scopeIndex)
+	assert.Equal(t, global, c.symbolTable)
+
+	c.emit(code.OpAdd)
+	assert.Equal(t, code.NewBuilder().Add(code.OpMul).Add(code.OpAdd).Build(), c.currentInstructions())
+	assert.Equal(t, code.OpMul, c.scopes[c.scopeIndex].previousInstruction.OpCode)
+}
+
+func TestCompilerPositions(t *testing.T) {
+	input := "let f = fn(x) {\n  x / 0\n};\nf(1)"
+
+	c := NewCompiler()
+	assert.NoError(t, c.Compile(parser.New(lexer.New(input)).ParseProgram()))
+	byteCode := c.ByteCode()
+
+	spans := func(ins code.Instructions, positions code.PositionTable) []string {
+		out := []string{}
+		for ip := 0; ip < len(ins); {
+			def, err := code.Lookup(ins[ip])
+			assert.NoError(t, err)
+
+			span, ok := positions.Lookup(ip)
+			assert.True(t, ok)
+			out = append(out, def.Name+" "+span.String())
+
+			_, read := code.ReadOperands(def, ins[ip+1:])
+			ip += 1 + read
+		}
+		return out
+	}
+
+	assert.Equal(t, []string{
+		"OpClosure 1:9-3:2",
+		"OpSetGlobal 1:1-3:2",
+		"OpGetGlobal 4:1-4:2",
+		"OpConstant 4:3-4:4",
+		"OpCall 4:1-4:5",
+		"OpPop 4:1-4:5",
+	}, spans(byteCode.Instructions, byteCode.Positions))
+
+	fn := byteCode.Constants[1].(*object.CompiledFunction)
+	assert.Equal(t, []string{
+		"OpGetLocal 2:3-2:4",
+		"OpConstant 2:7-2:8",
+		"OpDiv 2:3-2:8",
+		"OpReturnValue 2:3-2:8",
+	}, spans(fn.Instructions, fn.Positions))
+}
+
+func TestCompilerPositionsRemovedPop(t *testing.T) {
+	c := NewCompiler()
+	assert.NoError(t, c.Compile(parser.New(lexer.New("if (true) { 1 }")).ParseProgram()))
+
+	// the entry of the OpPop dropped from the block value is dropped too,
+	// and instructions from the same node share one entry
+	var positions []string
+	for _, p := range c.ByteCode().Positions {
+		positions = append(positions, fmt.Sprintf("%04d %s", p.Offset, p.Span))
+	}
+	assert.Equal(t, []string{"0000 1:5-1:9", "0001 1:1-1:16", "0004 1:13-1:14", "0007 1:1-1:16"}, positions)
+}
@@ -0,0 +1,445 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"lang_vm/code"
+	"lang_vm/object"
+	"sort"
+)
+
+// The byte code file format, all integers big endian unless noted:
+//
+//	magic          4 bytes  "LVMB"
+//	format version uint16   formatVersion
+//	opcode set     uint16   code.Version the byte code was compiled for
+//	flags          uint16   flagDebug if source positions are included
+//	constants      uvarint count, then per constant a tag byte followed by
+//	               tagInteger:  varint value
+//	               tagString:   uvarint length, bytes
+//	               tagFunction: uvarint locals, uvarint parameters,
+//	                            string name, instructions, positions
+//	instructions   uvarint length, bytes
+//	positions      uvarint length, code.LineTable bytes (flagDebug only)
+//	builtins       uvarint count, then per builtin the code uses its
+//	               OpGetBuiltin operand byte and string name
+//	checksum       uint32   CRC-32 (IEEE) of everything before it
+//
+// Strings, instructions and positions of functions use the same encodings
+// as their top level counterparts. Builtins are named because their
+// indexes depend on the order the host registered them in.
+const (
+	formatVersion = 2
+
+	flagDebug = 1 << 0
+
+	tagInteger  = 1
+	tagString   = 2
+	tagFunction = 3
+)
+
+var magic = []byte("LVMB")
+
+// Encode writes the byte code in the format described above. Source
+// positions are included if the byte code has any.
+func (b *ByteCode) Encode(w io.Writer) error {
+	e := &encoder{debug: b.hasPositions()}
+
+	e.buf.Write(magic)
+	e.uint16(formatVersion)
+	e.uint16(code.Version)
+	if e.debug {
+		e.uint16(flagDebug)
+	} else {
+		e.uint16(0)
+	}
+
+	e.uvarint(uint64(len(b.Constants)))
+	for i, constant := range b.Constants {
+		if err := e.constant(constant); err != nil {
+			return fmt.Errorf("constant %d: %w", i, err)
+		}
+	}
+
+	e.bytes(b.Instructions)
+	e.positions(b.Positions)
+
+	builtins := b.usedBuiltins()
+	e.uvarint(uint64(len(builtins)))
+	for _, idx := range builtins {
+		builtin, ok := object.GetBuiltin(idx)
+		if !ok {
+			return fmt.Errorf("undefined builtin %d", idx)
+		}
+		e.buf.WriteByte(byte(idx))
+		e.bytes([]byte(builtin.Name))
+	}
+
+	if err := binary.Write(&e.buf, binary.BigEndian, crc32.ChecksumIEEE(e.buf.Bytes())); err != nil {
+		return err
+	}
+
+	_, err := w.Write(e.buf.Bytes())
+	return err
+}
+
+func (b *ByteCode) hasPositions() bool {
+	if len(b.Positions) > 0 {
+		return true
+	}
+
+	for _, constant := range b.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok && len(fn.Positions) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// usedBuiltins returns the indexes of the builtins the byte code loads, in
+// ascending order.
+func (b *ByteCode) usedBuiltins() []int {
+	used := make(map[int]bool)
+	for _, ins := range b.allInstructions() {
+		builtinOperands(ins, func(offset int) {
+			used[int(ins[offset])] = true
+		})
+	}
+
+	indexes := make([]int, 0, len(used))
+	for idx := range used {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	return indexes
+}
+
+// allInstructions returns the instructions of main and of every function.
+func (b *ByteCode) allInstructions() []code.Instructions {
+	all := []code.Instructions{b.Instructions}
+	for _, constant := range b.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			all = append(all, fn.Instructions)
+		}
+	}
+
+	return all
+}
+
+// builtinOperands calls visit with the offset of the operand of every
+// OpGetBuiltin in ins. It stops at the first malformed instruction, which
+// is left for vm.Verify to reject.
+func builtinOperands(ins code.Instructions, visit func(offset int)) {
+	for ip := 0; ip < len(ins); {
+		def, err := code.Lookup(ins[ip])
+		if err != nil {
+			return
+		}
+
+		width := def.OperandsWidth()
+		if ip+1+width > len(ins) {
+			return
+		}
+
+		if code.OpCode(ins[ip]) == code.OpGetBuiltin {
+			visit(ip + 1)
+		}
+		ip += 1 + width
+	}
+}
+
+type encoder struct {
+	buf   bytes.Buffer
+	debug bool
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.buf.Write(binary.BigEndian.AppendUint16(nil, v))
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *encoder) positions(p code.PositionTable) {
+	if e.debug {
+		e.bytes(p.Pack())
+	}
+}
+
+func (e *encoder) constant(obj object.Object) error {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		e.buf.WriteByte(tagInteger)
+		e.buf.Write(binary.AppendVarint(nil, obj.Value))
+	case *object.String:
+		e.buf.WriteByte(tagString)
+		e.bytes([]byte(obj.Value))
+	case *object.CompiledFunction:
+		e.buf.WriteByte(tagFunction)
+		e.uvarint(uint64(obj.NumLocals))
+		e.uvarint(uint64(obj.NumParameters))
+		e.bytes([]byte(obj.Name))
+		e.bytes(obj.Instructions)
+		e.positions(obj.Positions)
+	default:
+		return fmt.Errorf("cannot encode constant of type %s", obj.Type())
+	}
+
+	return nil
+}
+
+// Decode reads byte code written by Encode. It rejects input that is
+// truncated, corrupted, has trailing data or was built for another format
+// or opcode set. Builtins are looked up by name and their OpGetBuiltin
+// operands changed to the indexes they are registered at, a builtin that
+// isn't registered is an error. The instructions are not checked otherwise.
+func Decode(r io.Reader) (*ByteCode, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < len(magic)+3*2+4 || !bytes.Equal(data[:len(magic)], magic) {
+		return nil, fmt.Errorf("invalid byte code: not a byte code file")
+	}
+
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, fmt.Errorf("invalid byte code: checksum mismatch")
+	}
+
+	d := &decoder{data: body, off: len(magic)}
+
+	if version := d.uint16(); version != formatVersion {
+		return nil, fmt.Errorf("invalid byte code: unsupported format version %d", version)
+	}
+	if version := d.uint16(); version != code.Version {
+		return nil, fmt.Errorf("invalid byte code: built for opcode set %d, expected %d", version, code.Version)
+	}
+
+	flags := d.uint16()
+	if flags&^flagDebug != 0 {
+		return nil, fmt.Errorf("invalid byte code: unknown flags 0x%x", flags)
+	}
+	d.debug = flags&flagDebug != 0
+
+	numConstants := d.uvarint(maxConstants)
+	b := &ByteCode{Constants: make([]object.Object, 0, numConstants)}
+	for i := 0; i < numConstants && d.err == nil; i++ {
+		b.Constants = append(b.Constants, d.constant())
+	}
+
+	b.Instructions = d.bytes()
+	b.Positions = d.positions()
+	builtins := d.builtins()
+
+	if d.err == nil && d.off != len(d.data) {
+		d.fail("%d bytes of trailing data", len(d.data)-d.off)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if err := b.remapBuiltins(builtins); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// remapBuiltins replaces the OpGetBuiltin operands by the indexes the
+// builtins have in this process, builtins maps the former to the latter.
+func (b *ByteCode) remapBuiltins(builtins map[int]int) error {
+	for _, ins := range b.allInstructions() {
+		var err error
+		builtinOperands(ins, func(offset int) {
+			idx, ok := builtins[int(ins[offset])]
+			if !ok {
+				if err == nil {
+					err = fmt.Errorf("invalid byte code: builtin %d is not named", ins[offset])
+				}
+				return
+			}
+			ins[offset] = byte(idx)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decoder reads from data, the first error stops it and is kept in err.
+type decoder struct {
+	data  []byte
+	off   int
+	debug bool
+	err   error
+}
+
+func (d *decoder) fail(format string, a ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("invalid byte code at offset %d: %s", d.off, fmt.Sprintf(format, a...))
+	}
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil || len(d.data)-d.off < 2 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+
+	v := binary.BigEndian.Uint16(d.data[d.off:])
+	d.off += 2
+
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || d.off >= len(d.data) {
+		d.fail("unexpected end of data")
+		return 0
+	}
+
+	b := d.data[d.off]
+	d.off++
+
+	return b
+}
+
+// uvarint reads an unsigned varint that must not exceed max.
+func (d *decoder) uvarint(max int) int {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.data[d.off:])
+	if n <= 0 {
+		d.varintError(n)
+		return 0
+	}
+	if v > uint64(max) {
+		d.fail("value %d out of range, at most %d is allowed", v, max)
+		return 0
+	}
+	d.off += n
+
+	return int(v)
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(d.data[d.off:])
+	if n <= 0 {
+		d.varintError(n)
+		return 0
+	}
+	d.off += n
+
+	return v
+}
+
+// varintError reports a failed varint read, n is the result of the read.
+func (d *decoder) varintError(n int) {
+	if n == 0 {
+		d.fail("unexpected end of data")
+	} else {
+		d.fail("malformed varint")
+	}
+}
+
+func (d *decoder) bytes() []byte {
+	length := d.uvarint(len(d.data) - d.off)
+	if d.err != nil {
+		return nil
+	}
+
+	b := make([]byte, length)
+	copy(b, d.data[d.off:])
+	d.off += length
+
+	return b
+}
+
+func (d *decoder) positions() code.PositionTable {
+	if !d.debug {
+		return nil
+	}
+
+	lineTable := d.bytes()
+	if d.err != nil {
+		return nil
+	}
+
+	positions, err := code.LineTable(lineTable).Unpack()
+	if err != nil {
+		d.fail("%s", err)
+		return nil
+	}
+
+	return positions
+}
+
+// builtins reads the builtin names and returns the index each builtin is
+// registered at in this process by its operand in the byte code.
+func (d *decoder) builtins() map[int]int {
+	count := d.uvarint(object.MaxBuiltins)
+	builtins := make(map[int]int, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		operand := int(d.byte())
+		name := string(d.bytes())
+		if d.err != nil {
+			break
+		}
+
+		if _, ok := builtins[operand]; ok {
+			d.fail("builtin %d is named twice", operand)
+			break
+		}
+
+		idx, ok := object.LookupBuiltin(name)
+		if !ok {
+			d.fail("builtin %s is not registered", name)
+			break
+		}
+		builtins[operand] = idx
+	}
+
+	return builtins
+}
+
+func (d *decoder) constant() object.Object {
+	switch tag := d.byte(); tag {
+	case tagInteger:
+		return &object.Integer{Value: d.varint()}
+	case tagString:
+		return &object.String{Value: string(d.bytes())}
+	case tagFunction:
+		fn := &object.CompiledFunction{}
+		fn.NumLocals = d.uvarint(maxLocals)
+		fn.NumParameters = d.uvarint(fn.NumLocals)
+		fn.Name = string(d.bytes())
+		fn.Instructions = d.bytes()
+		fn.Positions = d.positions()
+		return fn
+	default:
+		d.fail("unknown constant tag %d", tag)
+		return nil
+	}
+}
@@ -0,0 +1,147 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"lang_vm/code"
+	"lang_vm/lexer"
+	"lang_vm/object"
+	"lang_vm/parser"
+	"testing"
+)
+
+func compileForEncoding(t *testing.T, input string) *ByteCode {
+	t.Helper()
+
+	c := NewCompiler()
+	assert.NoError(t, c.Compile(parser.New(lexer.New(input)).ParseProgram()))
+
+	return c.ByteCode()
+}
+
+func TestEncodeDecode(t *testing.T) {
+	tests := map[string]string{
+		"empty":    "",
+		"integers": "let a = -1234567; a * 2",
+		"strings":  `"héllo" + "\n" + ""`,
+		"closures": "let mk = fn(a) { let b = 2; fn(c) { a + b + c } }; mk(1)(3)",
+		"nested":   "let f = fn() { fn() { fn() { [1, {\"a\": 2}] } } }; f()()()",
+		"builtins": "let f = fn(xs) { push(rest(xs), len(xs)) }; f([1, 2]); len(\"abc\")",
+	}
+
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			original := compileForEncoding(t, input)
+
+			var buf bytes.Buffer
+			assert.NoError(t, original.Encode(&buf))
+
+			decoded, err := Decode(&buf)
+			assert.NoError(t, err)
+
+			if diff := cmp.Diff(original, decoded); diff != "" {
+				t.Errorf("round trip mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEncodeWithoutPositions(t *testing.T) {
+	original := compileForEncoding(t, "let f = fn(x) { x }; f(1)")
+
+	withPositions := &bytes.Buffer{}
+	assert.NoError(t, original.Encode(withPositions))
+
+	original.Positions = nil
+	original.Constants[0].(*object.CompiledFunction).Positions = nil
+
+	stripped := &bytes.Buffer{}
+	assert.NoError(t, original.Encode(stripped))
+	assert.Less(t, stripped.Len(), withPositions.Len())
+
+	decoded, err := Decode(stripped)
+	assert.NoError(t, err)
+	assert.Nil(t, decoded.Positions)
+	assert.Equal(t, original, decoded)
+}
+
+func TestEncodeUnsupportedConstant(t *testing.T) {
+	b := &ByteCode{Instructions: code.Instructions{}, Constants: []object.Object{&object.Boolean{Value: true}}}
+
+	assert.EqualError(t, b.Encode(&bytes.Buffer{}), "constant 0: cannot encode constant of type Boolean")
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, compileForEncoding(t, `let s = "abc"; fn(x) { x }(s)`).Encode(&buf))
+	valid := buf.Bytes()
+
+	// reseal replaces the checksum, so that the corruption itself is found
+	reseal := func(body []byte) []byte {
+		return binary.BigEndian.AppendUint32(body, crc32.ChecksumIEEE(body))
+	}
+	body := func() []byte {
+		return append([]byte{}, valid[:len(valid)-4]...)
+	}
+	patch := func(offset int, b ...byte) []byte {
+		data := body()
+		copy(data[offset:], b)
+		return reseal(data)
+	}
+
+	tests := map[string]struct {
+		data []byte
+		err  string
+	}{
+		"empty":            {data: []byte{}, err: "invalid byte code: not a byte code file"},
+		"bad_magic":        {data: patch(0, 'X'), err: "invalid byte code: not a byte code file"},
+		"bad_checksum":     {data: append(body(), 0, 0, 0, 0), err: "invalid byte code: checksum mismatch"},
+		"format_version":   {data: patch(4, 0, 9), err: "invalid byte code: unsupported format version 9"},
+		"opcode_set":       {data: patch(6, 0, 99), err: "invalid byte code: built for opcode set 99, expected 1"},
+		"unknown_flags":    {data: patch(8, 0, 6), err: "invalid byte code: unknown flags 0x6"},
+		"unknown_tag":      {data: patch(11, 9), err: "invalid byte code at offset 12: unknown constant tag 9"},
+		"string_too_long":  {data: patch(12, 100), err: "invalid byte code at offset 12: value 100 out of range, at most 74 is allowed"},
+		"too_many_params":  {data: patch(17, 3, 4), err: "invalid byte code at offset 18: value 4 out of range, at most 3 is allowed"},
+		"truncated":        {data: reseal(body()[:20]), err: "invalid byte code at offset 20: unexpected end of data"},
+		"malformed_varint": {data: patch(10, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff), err: "invalid byte code at offset 10: malformed varint"},
+		"trailing_data":    {data: reseal(append(body(), 0)), err: "invalid byte code at offset 86: 1 bytes of trailing data"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Decode(bytes.NewReader(tc.data))
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
+
+func TestDecodeBuiltins(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, compileForEncoding(t, "last([1, 2])").Encode(&buf))
+	valid := buf.Bytes()
+
+	// rename replaces the name of the builtin in the encoded byte code
+	rename := func(name string) []byte {
+		body := append([]byte{}, valid[:len(valid)-4]...)
+		copy(body[bytes.LastIndex(body, []byte("last")):], name)
+		return binary.BigEndian.AppendUint32(body, crc32.ChecksumIEEE(body))
+	}
+
+	decoded, err := Decode(bytes.NewReader(rename("rest")))
+	assert.NoError(t, err)
+
+	rest, _ := object.LookupBuiltin("rest")
+	assert.Equal(t, code.Make(code.OpGetBuiltin, rest), []byte(decoded.Instructions[:2]))
+
+	_, err = Decode(bytes.NewReader(rename("lost")))
+	assert.EqualError(t, err, "invalid byte code at offset 73: builtin lost is not registered")
+
+	last, _ := object.LookupBuiltin("last")
+	body := append([]byte{}, valid[:len(valid)-4]...)
+	body[bytes.Index(body, code.Make(code.OpGetBuiltin, last))+1] = 200
+	_, err = Decode(bytes.NewReader(binary.BigEndian.AppendUint32(body, crc32.ChecksumIEEE(body))))
+	assert.EqualError(t, err, "invalid byte code: builtin 200 is not named")
+}
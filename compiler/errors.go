@@ -0,0 +1,84 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"lang_vm/parser"
+	"lang_vm/token"
+	"strings"
+)
+
+// Diagnostic codes of compile errors, the parser's codes start with P.
+const (
+	CodeUndefinedVariable     = "C001"
+	CodeReturnOutsideFunction = "C002"
+	CodeLimitExceeded         = "C003"
+	CodeUnsupported           = "C004"
+	CodeDuplicateParameter    = "C005"
+)
+
+// Error is a compile error, located at the node it was found in.
+type Error struct {
+	Span    token.Span
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Diagnostic returns the error in the form the parser reports problems in,
+// so that both can be rendered by parser.RenderDiagnostics.
+func (e *Error) Diagnostic() parser.Diagnostic {
+	return parser.Diagnostic{Severity: parser.SeverityError, Span: e.Span, Code: e.Code, Message: e.Message}
+}
+
+// Errors is returned by Compile for a program or block with errors. The
+// compiler carries on with the next statement after an error, so that one
+// compilation reports all of them, in source order.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Message)
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// Diagnostics returns the errors as diagnostics, see Error.Diagnostic.
+func (e Errors) Diagnostics() []parser.Diagnostic {
+	diagnostics := make([]parser.Diagnostic, 0, len(e))
+	for _, err := range e {
+		diagnostics = append(diagnostics, err.Diagnostic())
+	}
+
+	return diagnostics
+}
+
+// errorf returns an error located at the node being compiled.
+func (c *Compiler) errorf(code, format string, a ...interface{}) *Error {
+	err := &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+	if c.node != nil {
+		err.Span = c.node.Span()
+	}
+
+	return err
+}
+
+// appendErrors adds err, an *Error or Errors, to errs.
+func appendErrors(errs Errors, err error) Errors {
+	var list Errors
+	if errors.As(err, &list) {
+		return append(errs, list...)
+	}
+
+	var single *Error
+	if errors.As(err, &single) {
+		return append(errs, single)
+	}
+
+	return append(errs, &Error{Code: CodeUnsupported, Message: err.Error()})
+}
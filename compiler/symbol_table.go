@@ -0,0 +1,138 @@
+package compiler
+
+import "lang_vm/object"
+
+type SymbolScope string
+
+const (
+	GlobalScope   SymbolScope = "Global"
+	LocalScope    SymbolScope = "Local"
+	FreeScope     SymbolScope = "Free"
+	FunctionScope SymbolScope = "Function"
+	BuiltinScope  SymbolScope = "Builtin"
+)
+
+type Symbol struct {
+	Name  string
+	Scope SymbolScope
+	Index int
+}
+
+// SymbolTable maps identifiers to the slots they are stored in. Tables
+// nest: a table with an Outer table is a local scope, the outermost table
+// holds the globals.
+type SymbolTable struct {
+	Outer *SymbolTable
+
+	// FreeSymbols are the symbols of enclosing local scopes referenced
+	// from this scope, in the order they have to be captured.
+	FreeSymbols []Symbol
+
+	// HostSymbols are the globals of a table created by NewHostSymbolTable
+	// that were defined on first use, in the order they were defined.
+	HostSymbols []Symbol
+
+	store          map[string]Symbol
+	numDefinitions int
+	host           bool
+}
+
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{store: make(map[string]Symbol), FreeSymbols: []Symbol{}}
+}
+
+// NewHostSymbolTable returns a global symbol table that defines names that
+// don't resolve otherwise as globals, instead of failing to resolve them.
+// The host running the byte code has to set these globals first.
+func NewHostSymbolTable() *SymbolTable {
+	s := NewSymbolTable()
+	s.host = true
+
+	return s
+}
+
+func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.Outer = outer
+
+	return s
+}
+
+// NumDefinitions returns the number of slots defined in this scope.
+func (s *SymbolTable) NumDefinitions() int {
+	return s.numDefinitions
+}
+
+func (s *SymbolTable) Define(name string) Symbol {
+	if symbol, ok := s.store[name]; ok && (symbol.Scope == GlobalScope || symbol.Scope == LocalScope) {
+		// redefinition reuses the existing slot
+		return symbol
+	}
+
+	symbol := Symbol{Name: name, Index: s.numDefinitions}
+	if s.Outer == nil {
+		symbol.Scope = GlobalScope
+	} else {
+		symbol.Scope = LocalScope
+	}
+
+	s.store[name] = symbol
+	s.numDefinitions++
+
+	return symbol
+}
+
+// DefineFunctionName binds the name of the function being compiled in
+// this scope, so that the function can refer to itself.
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Scope: FunctionScope, Index: 0}
+	s.store[name] = symbol
+
+	return symbol
+}
+
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	s.FreeSymbols = append(s.FreeSymbols, original)
+
+	symbol := Symbol{Name: original.Name, Scope: FreeScope, Index: len(s.FreeSymbols) - 1}
+	s.store[original.Name] = symbol
+
+	return symbol
+}
+
+// Resolve looks name up in this and the enclosing scopes. Names that are
+// not defined anywhere fall back to the registered builtins, so a global
+// can shadow a builtin.
+func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
+	symbol, ok := s.store[name]
+	if ok {
+		return symbol, ok
+	}
+
+	if s.Outer == nil {
+		symbol, ok = resolveBuiltin(name)
+		if !ok && s.host {
+			symbol, ok = s.Define(name), true
+			s.HostSymbols = append(s.HostSymbols, symbol)
+		}
+
+		return symbol, ok
+	}
+
+	symbol, ok = s.Outer.Resolve(name)
+	if !ok || symbol.Scope == GlobalScope || symbol.Scope == BuiltinScope {
+		return symbol, ok
+	}
+
+	// a local of an enclosing function has to be captured
+	return s.defineFree(symbol), true
+}
+
+func resolveBuiltin(name string) (Symbol, bool) {
+	idx, ok := object.LookupBuiltin(name)
+	if !ok {
+		return Symbol{}, false
+	}
+
+	return Symbol{Name: name, Scope: BuiltinScope, Index: idx}, true
+}
@@ -0,0 +1,124 @@
+package compiler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSymbolTableDefine(t *testing.T) {
+	global := NewSymbolTable()
+	assert.Equal(t, Symbol{Name: "a", Scope: GlobalScope, Index: 0}, global.Define("a"))
+	assert.Equal(t, Symbol{Name: "b", Scope: GlobalScope, Index: 1}, global.Define("b"))
+	assert.Equal(t, Symbol{Name: "a", Scope: GlobalScope, Index: 0}, global.Define("a"))
+
+	local := NewEnclosedSymbolTable(global)
+	assert.Equal(t, Symbol{Name: "c", Scope: LocalScope, Index: 0}, local.Define("c"))
+	assert.Equal(t, Symbol{Name: "a", Scope: LocalScope, Index: 1}, local.Define("a"))
+
+	assert.Equal(t, 2, global.NumDefinitions())
+	assert.Equal(t, 2, local.NumDefinitions())
+}
+
+func TestSymbolTableResolve(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	global.Define("b")
+	global.Define("first")
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("b")
+	local.Define("c")
+
+	tests := map[string]struct {
+		table    *SymbolTable
+		name     string
+		expected Symbol
+		ok       bool
+	}{
+		"global":           {global, "a", Symbol{Name: "a", Scope: GlobalScope, Index: 0}, true},
+		"global_unknown":   {global, "c", Symbol{}, false},
+		"local":            {local, "c", Symbol{Name: "c", Scope: LocalScope, Index: 1}, true},
+		"local_shadowing":  {local, "b", Symbol{Name: "b", Scope: LocalScope, Index: 0}, true},
+		"local_from_outer": {local, "a", Symbol{Name: "a", Scope: GlobalScope, Index: 0}, true},
+		"local_unknown":    {local, "d", Symbol{}, false},
+		"builtin":          {global, "len", Symbol{Name: "len", Scope: BuiltinScope, Index: 0}, true},
+		"local_builtin":    {local, "len", Symbol{Name: "len", Scope: BuiltinScope, Index: 0}, true},
+		"builtin_shadowed": {local, "first", Symbol{Name: "first", Scope: GlobalScope, Index: 2}, true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			symbol, ok := tc.table.Resolve(tc.name)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.expected, symbol)
+		})
+	}
+
+	assert.Empty(t, local.FreeSymbols)
+}
+
+func TestHostSymbolTable(t *testing.T) {
+	global := NewHostSymbolTable()
+	global.Define("a")
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("b")
+
+	tests := map[string]struct {
+		table    *SymbolTable
+		name     string
+		expected Symbol
+	}{
+		"defined": {global, "a", Symbol{Name: "a", Scope: GlobalScope, Index: 0}},
+		"host":    {global, "x", Symbol{Name: "x", Scope: GlobalScope, Index: 1}},
+		"again":   {global, "x", Symbol{Name: "x", Scope: GlobalScope, Index: 1}},
+		"local":   {local, "b", Symbol{Name: "b", Scope: LocalScope, Index: 0}},
+		"nested":  {local, "y", Symbol{Name: "y", Scope: GlobalScope, Index: 2}},
+		"builtin": {local, "len", Symbol{Name: "len", Scope: BuiltinScope, Index: 0}},
+	}
+
+	for _, name := range []string{"defined", "host", "again", "local", "nested", "builtin"} {
+		tc := tests[name]
+		t.Run(name, func(t *testing.T) {
+			symbol, ok := tc.table.Resolve(tc.name)
+			assert.True(t, ok)
+			assert.Equal(t, tc.expected, symbol)
+		})
+	}
+
+	assert.Equal(t, []Symbol{{Name: "x", Scope: GlobalScope, Index: 1}, {Name: "y", Scope: GlobalScope, Index: 2}}, global.HostSymbols)
+	assert.Empty(t, local.HostSymbols)
+}
+
+func TestSymbolTableFreeVariables(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	first := NewEnclosedSymbolTable(global)
+	first.Define("b")
+
+	second := NewEnclosedSymbolTable(first)
+	second.DefineFunctionName("self")
+	second.Define("c")
+
+	tests := map[string]struct {
+		name     string
+		expected Symbol
+	}{
+		"global":   {"a", Symbol{Name: "a", Scope: GlobalScope, Index: 0}},
+		"free":     {"b", Symbol{Name: "b", Scope: FreeScope, Index: 0}},
+		"local":    {"c", Symbol{Name: "c", Scope: LocalScope, Index: 0}},
+		"function": {"self", Symbol{Name: "self", Scope: FunctionScope, Index: 0}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			symbol, ok := second.Resolve(tc.name)
+			assert.True(t, ok)
+			assert.Equal(t, tc.expected, symbol)
+		})
+	}
+
+	assert.Equal(t, []Symbol{{Name: "b", Scope: LocalScope, Index: 0}}, second.FreeSymbols)
+	assert.Empty(t, first.FreeSymbols)
+}
@@ -3,6 +3,9 @@ package lexer
 import (
 	"fmt"
 	"lang_vm/token"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 //go:generate mockery --name ILexer
@@ -15,15 +18,30 @@ type Lexer struct {
 	position     int
 	nextPosition int
 	ch           byte
+
+	// line is the current line number and lineStart the offset at which
+	// it begins, used to derive token positions.
+	line      int
+	lineStart int
 }
 
 func New(input string) *Lexer {
-	if len(input) > 0 {
-		l := &Lexer{input: input, position: 0, nextPosition: 0, ch: 0}
-		return l
-	}
+	l := &Lexer{input: input, position: 0, nextPosition: 0, ch: 0, line: 1, lineStart: 0}
+	l.readChar()
+
+	return l
+}
+
+// NewAt returns a lexer for input starting at offset. Token positions count
+// from the start of input, so that they continue from the text before
+// offset.
+func NewAt(input string, offset int) *Lexer {
+	l := &Lexer{input: input, position: offset, nextPosition: offset, ch: 0}
+	l.line = 1 + strings.Count(input[:offset], "\n")
+	l.lineStart = strings.LastIndexByte(input[:offset], '\n') + 1
+	l.readChar()
 
-	return &Lexer{input: input, position: 0, nextPosition: 0, ch: 0}
+	return l
 }
 
 func (l *Lexer) getAllTokens() []token.Token {
@@ -42,15 +60,19 @@ func (l *Lexer) getAllTokens() []token.Token {
 }
 
 func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
+	skipWhiteSpaces(l)
 
-	if l.position >= len(l.input) {
-		l.ch = 0
-	} else {
-		l.ch = l.input[l.position]
-	}
+	start := l.pos()
+	tok := l.readToken()
+	tok.Span = token.Span{Start: start, End: l.pos()}
 
-	skipWhiteSpaces(l)
+	return tok
+}
+
+// readToken reads the token starting at the current character and
+// advances past it.
+func (l *Lexer) readToken() token.Token {
+	var tok token.Token
 
 	switch {
 	case l.ch == '{':
@@ -60,7 +82,8 @@ func (l *Lexer) NextToken() token.Token {
 		tok = token.Token{Type: token.RightBrace, Literal: "}"}
 	// Digit
 	case '0' <= l.ch && l.ch <= '9':
-		tok = token.Token{Type: token.Int, Literal: getNumber(l)}
+		// getNumber already advances past the literal
+		return token.Token{Type: token.Int, Literal: getNumber(l)}
 
 	case l.ch == '+':
 		tok = token.Token{Type: token.Plus, Literal: string(l.ch)}
@@ -68,6 +91,9 @@ func (l *Lexer) NextToken() token.Token {
 	case l.ch == '-':
 		tok = token.Token{Type: token.Minus, Literal: string(l.ch)}
 
+	case l.ch == '!':
+		tok = l.readOneOrTwoCharToken('=', token.Bang, token.NotEqual)
+
 	case l.ch == '*':
 		tok = token.Token{Type: token.Asterisk, Literal: string(l.ch)}
 
@@ -81,17 +107,46 @@ func (l *Lexer) NextToken() token.Token {
 		tok = token.Token{Type: token.RightParen, Literal: string(l.ch)}
 
 	case l.ch == '<':
-		tok = token.Token{Type: token.LessThan, Literal: string(l.ch)}
+		tok = l.readOneOrTwoCharToken('=', token.LessThan, token.LessThanOrEqual)
+
+	case l.ch == '>':
+		tok = l.readOneOrTwoCharToken('=', token.GreaterThan, token.GreaterThanOrEqual)
+
+	case l.ch == '=':
+		tok = l.readOneOrTwoCharToken('=', token.Assign, token.Equal)
+
+	case l.ch == ',':
+		tok = token.Token{Type: token.Comma, Literal: string(l.ch)}
+
+	case l.ch == '"':
+		// readString already advances past the closing quote
+		return l.readString()
+
+	case l.ch == '[':
+		tok = token.Token{Type: token.LeftBracket, Literal: string(l.ch)}
+
+	case l.ch == ']':
+		tok = token.Token{Type: token.RightBracket, Literal: string(l.ch)}
+
+	case l.ch == ':':
+		tok = token.Token{Type: token.Colon, Literal: string(l.ch)}
+
+	case l.ch == ';':
+		tok = token.Token{Type: token.Semicolon, Literal: string(l.ch)}
 
 	case isLetter(l.ch):
+		// readIdentifier already advances past the identifier
 		identifier := l.readIdentifier()
-		tok = token.Token{
+		return token.Token{
 			Type:    token.LookupIdentifierType(identifier),
 			Literal: identifier,
 		}
 
 	case l.ch == 0:
-		tok = token.Token{Type: token.EOF}
+		return token.Token{Type: token.EOF}
+
+	default:
+		tok = token.Token{Type: token.Illegal, Literal: string(l.ch)}
 	}
 
 	l.readChar()
@@ -99,6 +154,107 @@ func (l *Lexer) NextToken() token.Token {
 	return tok
 }
 
+// readOneOrTwoCharToken returns a token of type two if the current character
+// is followed by next, consuming both characters, and a token of type one
+// otherwise.
+func (l *Lexer) readOneOrTwoCharToken(next byte, one, two token.TokenType) token.Token {
+	if l.peekChar() == next {
+		ch := l.ch
+		l.readChar()
+		return token.Token{Type: two, Literal: string(ch) + string(l.ch)}
+	}
+
+	return token.Token{Type: one, Literal: string(l.ch)}
+}
+
+// readString reads a double quoted string literal and returns a String
+// token holding its unescaped value. Supported escapes are \n, \t, \",
+// \\ and \u{XXXX} with one to six hex digits. An unterminated literal or an
+// invalid escape yields an Illegal token holding the raw source text.
+func (l *Lexer) readString() token.Token {
+	start := l.position
+	var out strings.Builder
+	valid := true
+
+	l.readChar()
+	for l.ch != '"' {
+		switch l.ch {
+		case 0:
+			return token.Token{Type: token.Illegal, Literal: l.input[start:l.position]}
+
+		case '\\':
+			l.readChar()
+			if !l.readEscape(&out) {
+				valid = false
+				continue
+			}
+
+		default:
+			out.WriteByte(l.ch)
+		}
+
+		l.readChar()
+	}
+
+	// skip the closing quote
+	l.readChar()
+
+	if !valid {
+		return token.Token{Type: token.Illegal, Literal: l.input[start:l.position]}
+	}
+
+	return token.Token{Type: token.String, Literal: out.String()}
+}
+
+// readEscape decodes the escape sequence whose first character after the
+// backslash is the current character. It leaves the lexer on the last
+// character of the sequence.
+func (l *Lexer) readEscape(out *strings.Builder) bool {
+	switch l.ch {
+	case 'n':
+		out.WriteByte('\n')
+	case 't':
+		out.WriteByte('\t')
+	case '"':
+		out.WriteByte('"')
+	case '\\':
+		out.WriteByte('\\')
+	case 'u':
+		if l.peekChar() != '{' {
+			return false
+		}
+		l.readChar()
+
+		digits := l.position + 1
+		for isHexDigit(l.peekChar()) {
+			l.readChar()
+		}
+		if l.peekChar() != '}' {
+			return false
+		}
+
+		hex := l.input[digits : l.position+1]
+		l.readChar()
+
+		if len(hex) == 0 || len(hex) > 6 {
+			return false
+		}
+		code, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return false
+		}
+		out.WriteRune(rune(code))
+	default:
+		return false
+	}
+
+	return true
+}
+
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
+}
+
 func isLetter(ch byte) bool {
 	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
 }
@@ -139,7 +295,16 @@ func (l *Lexer) peekChar() byte {
 	return l.input[l.nextPosition]
 }
 
+func (l *Lexer) pos() token.Pos {
+	return token.Pos{Line: l.line, Column: l.position - l.lineStart + 1, Offset: l.position}
+}
+
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.lineStart = l.nextPosition
+	}
+
 	l.ch = l.peekChar()
 	l.position = l.nextPosition
 	l.nextPosition++
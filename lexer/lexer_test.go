@@ -2,6 +2,7 @@ package lexer
 
 import (
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"lang_vm/token"
 	"testing"
 )
@@ -19,24 +20,99 @@ func TestLexer(t *testing.T) {
 		},
 		"addition": {
 			"2 + 5",
-			[]token.Token{{token.Int, "2"}, {token.Plus, "+"},
-				{token.Int, "5"}},
+			[]token.Token{{Type: token.Int, Literal: "2"}, {Type: token.Plus, Literal: "+"},
+				{Type: token.Int, Literal: "5"}},
 		},
 		"minus": {
 			"223 - 512312",
-			[]token.Token{{token.Int, "223"}, {token.Minus, "-"},
-				{token.Int, "512312"}},
+			[]token.Token{{Type: token.Int, Literal: "223"}, {Type: token.Minus, Literal: "-"},
+				{Type: token.Int, Literal: "512312"}},
 		},
 		"complex": {
 			"2*(5+5*2)/3+(6/2+8)",
-			[]token.Token{{token.Int, "2"}, {token.Asterisk, "*"},
-				{token.LeftParen, "("}, {token.Int, "5"}, {token.Plus, "+"},
-				{token.Int, "5"}, {token.Asterisk, "*"}, {token.Int, "2"},
-				{token.RightParen, ")"}, {token.Slash, "/"}, {token.Int, "3"},
-				{token.Plus, "+"},
-				{token.LeftParen, "("}, {token.Int, "6"}, {token.Slash, "/"},
-				{token.Int, "2"}, {token.Plus, "+"}, {token.Int, "8"},
-				{token.RightParen, ")"}},
+			[]token.Token{{Type: token.Int, Literal: "2"}, {Type: token.Asterisk, Literal: "*"},
+				{Type: token.LeftParen, Literal: "("}, {Type: token.Int, Literal: "5"}, {Type: token.Plus, Literal: "+"},
+				{Type: token.Int, Literal: "5"}, {Type: token.Asterisk, Literal: "*"}, {Type: token.Int, Literal: "2"},
+				{Type: token.RightParen, Literal: ")"}, {Type: token.Slash, Literal: "/"}, {Type: token.Int, Literal: "3"},
+				{Type: token.Plus, Literal: "+"},
+				{Type: token.LeftParen, Literal: "("}, {Type: token.Int, Literal: "6"}, {Type: token.Slash, Literal: "/"},
+				{Type: token.Int, Literal: "2"}, {Type: token.Plus, Literal: "+"}, {Type: token.Int, Literal: "8"},
+				{Type: token.RightParen, Literal: ")"}},
+		},
+		"let_statement": {
+			"let total_sum = x;",
+			[]token.Token{{Type: token.Let, Literal: "let"},
+				{Type: token.Identifier, Literal: "total_sum"},
+				{Type: token.Assign, Literal: "="}, {Type: token.Identifier, Literal: "x"},
+				{Type: token.Semicolon, Literal: ";"}},
+		},
+		"function_call": {
+			"add(a, b)",
+			[]token.Token{{Type: token.Identifier, Literal: "add"},
+				{Type: token.LeftParen, Literal: "("}, {Type: token.Identifier, Literal: "a"},
+				{Type: token.Comma, Literal: ","}, {Type: token.Identifier, Literal: "b"},
+				{Type: token.RightParen, Literal: ")"}},
+		},
+		"prefix_operators": {
+			"!true - -5",
+			[]token.Token{{Type: token.Bang, Literal: "!"},
+				{Type: token.True, Literal: "true"}, {Type: token.Minus, Literal: "-"},
+				{Type: token.Minus, Literal: "-"}, {Type: token.Int, Literal: "5"}},
+		},
+		"comparison_operators": {
+			"a == b != c < d <= e > f >= g = !h",
+			[]token.Token{{Type: token.Identifier, Literal: "a"},
+				{Type: token.Equal, Literal: "=="}, {Type: token.Identifier, Literal: "b"},
+				{Type: token.NotEqual, Literal: "!="}, {Type: token.Identifier, Literal: "c"},
+				{Type: token.LessThan, Literal: "<"}, {Type: token.Identifier, Literal: "d"},
+				{Type: token.LessThanOrEqual, Literal: "<="}, {Type: token.Identifier, Literal: "e"},
+				{Type: token.GreaterThan, Literal: ">"}, {Type: token.Identifier, Literal: "f"},
+				{Type: token.GreaterThanOrEqual, Literal: ">="}, {Type: token.Identifier, Literal: "g"},
+				{Type: token.Assign, Literal: "="}, {Type: token.Bang, Literal: "!"},
+				{Type: token.Identifier, Literal: "h"}},
+		},
+		"comparison_without_spaces": {
+			"1<=2==!x",
+			[]token.Token{{Type: token.Int, Literal: "1"},
+				{Type: token.LessThanOrEqual, Literal: "<="}, {Type: token.Int, Literal: "2"},
+				{Type: token.Equal, Literal: "=="}, {Type: token.Bang, Literal: "!"},
+				{Type: token.Identifier, Literal: "x"}},
+		},
+		"strings": {
+			`"hello" + "" + "a b"`,
+			[]token.Token{{Type: token.String, Literal: "hello"},
+				{Type: token.Plus, Literal: "+"}, {Type: token.String, Literal: ""},
+				{Type: token.Plus, Literal: "+"}, {Type: token.String, Literal: "a b"}},
+		},
+		"string_escapes": {
+			`"tab\there\n\"quoted\" back\\slash \u{48}\u{e9}\u{1F600}"`,
+			[]token.Token{{Type: token.String, Literal: "tab\there\n\"quoted\" back\\slash Hé😀"}},
+		},
+		"string_unknown_escape": {
+			`"a\qb" 1`,
+			[]token.Token{{Type: token.Illegal, Literal: `"a\qb"`}, {Type: token.Int, Literal: "1"}},
+		},
+		"string_invalid_code_point": {
+			`"\u{110000}" "\u{}" "\u{41"`,
+			[]token.Token{{Type: token.Illegal, Literal: `"\u{110000}"`},
+				{Type: token.Illegal, Literal: `"\u{}"`}, {Type: token.Illegal, Literal: `"\u{41"`}},
+		},
+		"brackets": {
+			"[1, 2][0]",
+			[]token.Token{{Type: token.LeftBracket, Literal: "["}, {Type: token.Int, Literal: "1"},
+				{Type: token.Comma, Literal: ","}, {Type: token.Int, Literal: "2"},
+				{Type: token.RightBracket, Literal: "]"}, {Type: token.LeftBracket, Literal: "["},
+				{Type: token.Int, Literal: "0"}, {Type: token.RightBracket, Literal: "]"}},
+		},
+		"hash": {
+			`{"a": 1}`,
+			[]token.Token{{Type: token.LeftBrace, Literal: "{"}, {Type: token.String, Literal: "a"},
+				{Type: token.Colon, Literal: ":"}, {Type: token.Int, Literal: "1"},
+				{Type: token.RightBrace, Literal: "}"}},
+		},
+		"string_unterminated": {
+			`1 "abc`,
+			[]token.Token{{Type: token.Int, Literal: "1"}, {Type: token.Illegal, Literal: `"abc`}},
 		},
 	}
 
@@ -45,9 +121,58 @@ func TestLexer(t *testing.T) {
 			l := New(test.input)
 			got := l.getAllTokens()
 
-			if diff := cmp.Diff(got, test.expectedTokens); diff != "" {
+			ignoreSpans := cmpopts.IgnoreFields(token.Token{}, "Span")
+			if diff := cmp.Diff(got, test.expectedTokens, ignoreSpans); diff != "" {
 				t.Errorf("expected: %v, got: %v", test.expectedTokens, got)
 			}
 		})
 	}
 }
+
+func TestLexerPositions(t *testing.T) {
+	input := "let x = 10;\n  x >= 5\n"
+
+	expected := []token.Token{
+		{Type: token.Let, Literal: "let", Span: span(1, 1, 0, 1, 4, 3)},
+		{Type: token.Identifier, Literal: "x", Span: span(1, 5, 4, 1, 6, 5)},
+		{Type: token.Assign, Literal: "=", Span: span(1, 7, 6, 1, 8, 7)},
+		{Type: token.Int, Literal: "10", Span: span(1, 9, 8, 1, 11, 10)},
+		{Type: token.Semicolon, Literal: ";", Span: span(1, 11, 10, 1, 12, 11)},
+		{Type: token.Identifier, Literal: "x", Span: span(2, 3, 14, 2, 4, 15)},
+		{Type: token.GreaterThanOrEqual, Literal: ">=", Span: span(2, 5, 16, 2, 7, 18)},
+		{Type: token.Int, Literal: "5", Span: span(2, 8, 19, 2, 9, 20)},
+		{Type: token.EOF, Literal: "", Span: span(3, 1, 21, 3, 1, 21)},
+	}
+
+	l := New(input)
+	for i, want := range expected {
+		got := l.NextToken()
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("token %d mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+}
+
+func TestLexerNewAt(t *testing.T) {
+	input := "let x = 10;\n  x >= 5\n"
+
+	expected := []token.Token{
+		{Type: token.Semicolon, Literal: ";", Span: span(1, 11, 10, 1, 12, 11)},
+		{Type: token.Identifier, Literal: "x", Span: span(2, 3, 14, 2, 4, 15)},
+	}
+
+	l := NewAt(input, 10)
+	for i, want := range expected {
+		got := l.NextToken()
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("token %d mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+}
+
+func span(startLine, startColumn, startOffset, endLine, endColumn, endOffset int) token.Span {
+	return token.Span{
+		Start: token.Pos{Line: startLine, Column: startColumn, Offset: startOffset},
+		End:   token.Pos{Line: endLine, Column: endColumn, Offset: endOffset},
+	}
+}
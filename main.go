@@ -1,36 +1,365 @@
+// Command lang_vm compiles and runs scripts.
+//
+// Scripts conventionally end in .lv, byte code files written by build in
+// .lvb.
 package main
 
 import (
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"lang_vm/ast"
+	"lang_vm/code"
 	"lang_vm/compiler"
 	"lang_vm/lexer"
+	"lang_vm/object"
 	"lang_vm/parser"
-	"log"
+	"lang_vm/repl"
+	"lang_vm/vm"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const usage = `usage: lang_vm <command> [arguments]
+
+commands:
+  run <file.lv>             compile and run a script
+  build [-o file] <file.lv> compile a script to a byte code file
+  exec <file.lvb>           run a byte code file
+  disasm [-source] <file>   print the instructions and constants of a script
+                            or byte code file
+  ast <file.lv>             print the syntax tree of a script
+  check <file.lv>...        parse and compile scripts, reporting problems
+  repl                      start the interactive REPL
+`
+
+// Exit codes.
+const (
+	exitOK = 0
+
+	// exitFailure is used when a script has errors or fails at run time.
+	exitFailure = 1
+	exitUsage   = 2
 )
 
 func main() {
-	input := `
-		if (5 + 10) {
-			4 + 5
-		} else {
-			99 + 99
-			55 - 8
+	os.Exit(runCommand(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+type cli struct {
+	stdin          io.Reader
+	stdout, stderr io.Writer
+}
+
+// runCommand runs the command named by args[0] and returns the exit code.
+func runCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	commands := map[string]func([]string) int{
+		"run":    c.run,
+		"build":  c.build,
+		"exec":   c.exec,
+		"disasm": c.disasm,
+		"ast":    c.ast,
+		"check":  c.check,
+		"repl":   c.repl,
+	}
+
+	switch name := args[0]; name {
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	default:
+		command, ok := commands[name]
+		if !ok {
+			fmt.Fprintf(stderr, "lang_vm: unknown command %s\n\n%s", name, usage)
+			return exitUsage
 		}
-`
 
-	l := lexer.New(input)
-	p := parser.New(l)
+		return command(args[1:])
+	}
+}
+
+func (c *cli) run(args []string) int {
+	path, ok := c.oneFile("run", args)
+	if !ok {
+		return exitUsage
+	}
+
+	source, byteCode, ok := c.compile(path)
+	if !ok {
+		return exitFailure
+	}
+
+	return c.execute(byteCode, path, source)
+}
+
+func (c *cli) build(args []string) int {
+	flags := c.flagSet("build")
+	out := flags.String("o", "", "write the byte code to `file` instead of the script name with a .lvb extension")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	path, ok := c.oneFile("build", flags.Args())
+	if !ok {
+		return exitUsage
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(path, filepath.Ext(path)) + ".lvb"
+	}
+
+	_, byteCode, ok := c.compile(path)
+	if !ok {
+		return exitFailure
+	}
+
+	var buf bytes.Buffer
+	if err := byteCode.Encode(&buf); err != nil {
+		return c.fail("%s: %s", path, err)
+	}
+	if err := os.WriteFile(*out, buf.Bytes(), 0o644); err != nil {
+		return c.fail("%s", err)
+	}
+
+	return exitOK
+}
+
+func (c *cli) exec(args []string) int {
+	path, ok := c.oneFile("exec", args)
+	if !ok {
+		return exitUsage
+	}
+
+	byteCode, ok := c.load(path)
+	if !ok {
+		return exitFailure
+	}
+
+	// the source isn't available, so errors only show line and column
+	return c.execute(byteCode, "", "")
+}
+
+func (c *cli) disasm(args []string) int {
+	flags := c.flagSet("disasm")
+	withSource := flags.Bool("source", false, "interleave the source lines, only for scripts")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	path, ok := c.oneFile("disasm", flags.Args())
+	if !ok {
+		return exitUsage
+	}
+
+	var source string
+	var byteCode *compiler.ByteCode
+	if isByteCodeFile(path) {
+		if *withSource {
+			return c.fail("%s: -source needs a script, not a byte code file", path)
+		}
+		byteCode, ok = c.load(path)
+	} else {
+		source, byteCode, ok = c.compile(path)
+	}
+	if !ok {
+		return exitFailure
+	}
+
+	listing := func(ins code.Instructions, positions code.PositionTable) string {
+		if *withSource {
+			return code.Disassemble(ins, positions, source)
+		}
+		return ins.String()
+	}
+
+	fmt.Fprintln(c.stdout, "<main>:")
+	fmt.Fprint(c.stdout, listing(byteCode.Instructions, byteCode.Positions))
+
+	for i, constant := range byteCode.Constants {
+		fmt.Fprintf(c.stdout, "\nconstant %d: %s\n", i, describeConstant(constant))
+
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			fmt.Fprint(c.stdout, listing(fn.Instructions, fn.Positions))
+		}
+	}
+
+	return exitOK
+}
+
+func (c *cli) ast(args []string) int {
+	path, ok := c.oneFile("ast", args)
+	if !ok {
+		return exitUsage
+	}
+
+	_, program, ok := c.parse(path)
+	if !ok {
+		return exitFailure
+	}
+
+	for _, statement := range program.Statements {
+		fmt.Fprintln(c.stdout, statement.String())
+	}
+
+	return exitOK
+}
+
+// check reports the problems of every file instead of stopping at the
+// first one that has any.
+func (c *cli) check(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(c.stderr, "usage: lang_vm check <file.lv>...\n")
+		return exitUsage
+	}
+
+	status := exitOK
+	for _, path := range args {
+		if _, _, ok := c.compile(path); !ok {
+			status = exitFailure
+		}
+	}
+
+	return status
+}
+
+func (c *cli) repl(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(c.stderr, "usage: lang_vm repl\n")
+		return exitUsage
+	}
+
+	if err := repl.Start(c.stdin, c.stdout); err != nil {
+		return c.fail("%s", err)
+	}
+
+	return exitOK
+}
+
+func (c *cli) flagSet(command string) *flag.FlagSet {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+
+	return flags
+}
+
+// oneFile checks that args is a single file name.
+func (c *cli) oneFile(command string, args []string) (string, bool) {
+	if len(args) != 1 {
+		fmt.Fprintf(c.stderr, "usage: lang_vm %s: expected one file, got %d arguments\n", command, len(args))
+		return "", false
+	}
+
+	return args[0], true
+}
+
+// fail prints an error message and returns exitFailure.
+func (c *cli) fail(format string, a ...interface{}) int {
+	fmt.Fprintf(c.stderr, "lang_vm: "+format+"\n", a...)
+	return exitFailure
+}
+
+// parse reads and parses a script, printing its diagnostics if it has any.
+func (c *cli) parse(path string) (string, *ast.Program, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		c.fail("%s", err)
+		return "", nil, false
+	}
+	source := string(data)
+
+	p := parser.New(lexer.New(source))
 	program := p.ParseProgram()
+	if len(p.Diagnostics()) > 0 {
+		fmt.Fprint(c.stderr, parser.RenderDiagnostics(path, source, p.Diagnostics()))
+		return "", nil, false
+	}
+
+	return source, program, true
+}
+
+// compile parses and compiles a script, printing its problems if it has any.
+func (c *cli) compile(path string) (string, *compiler.ByteCode, bool) {
+	source, program, ok := c.parse(path)
+	if !ok {
+		return "", nil, false
+	}
+
+	comp := compiler.NewCompiler()
+	if err := comp.Compile(program); err != nil {
+		var errs compiler.Errors
+		if errors.As(err, &errs) {
+			fmt.Fprint(c.stderr, parser.RenderDiagnostics(path, source, errs.Diagnostics()))
+		} else {
+			c.fail("%s: compile error: %s", path, err)
+		}
+		return "", nil, false
+	}
+
+	return source, comp.ByteCode(), true
+}
 
-	c := compiler.NewCompiler()
-	err := c.Compile(program)
+// load reads a byte code file.
+func (c *cli) load(path string) (*compiler.ByteCode, bool) {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Fatalf("error encountered: %v", err)
+		c.fail("%s", err)
+		return nil, false
 	}
+	defer f.Close()
 
-	fmt.Println(c.ByteCode().Instructions.String())
+	byteCode, err := compiler.Decode(f)
+	if err != nil {
+		c.fail("%s: %s", path, err)
+		return nil, false
+	}
+
+	return byteCode, true
+}
 
-	//for _, statement := range program.Statements {
-	//	fmt.Printf("%v\n", statement.String())
-	//}
+// execute runs byte code compiled from source, which is used to show the
+// source lines of runtime errors.
+func (c *cli) execute(byteCode *compiler.ByteCode, filename, source string) int {
+	machine := vm.New(byteCode)
+	machine.SetOutput(c.stdout)
+
+	err := machine.Run()
+	if err == nil {
+		return exitOK
+	}
+
+	var runtimeErr *vm.RuntimeError
+	if errors.As(err, &runtimeErr) {
+		fmt.Fprint(c.stderr, runtimeErr.Render(filename, source))
+		return exitFailure
+	}
+
+	return c.fail("%s", err)
+}
+
+func isByteCodeFile(path string) bool {
+	return filepath.Ext(path) == ".lvb"
+}
+
+func describeConstant(constant object.Object) string {
+	switch constant := constant.(type) {
+	case *object.String:
+		return fmt.Sprintf("%s %q", constant.Type(), constant.Value)
+	case *object.CompiledFunction:
+		name := constant.Name
+		if name == "" {
+			name = "<anonymous>"
+		}
+		return fmt.Sprintf("%s %s, %d parameters, %d locals", constant.Type(), name, constant.NumParameters, constant.NumLocals)
+	default:
+		return fmt.Sprintf("%s %s", constant.Type(), constant.Inspect())
+	}
 }
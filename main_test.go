@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeScripts writes the scripts to a temporary directory and returns its
+// path.
+func writeScripts(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, source := range scripts {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(source), 0o644))
+	}
+
+	return dir
+}
+
+func TestCommands(t *testing.T) {
+	dir := writeScripts(t, map[string]string{
+		"ok.lv":      "let add = fn(a, b) { a + b };\nadd(1, 2);\n",
+		"syntax.lv":  "let = 1;\n",
+		"compile.lv": "x;\nlet f = fn() {\n  return y;\n};\n",
+		"runtime.lv": "let div = fn(a, b) {\n  a / b\n};\ndiv(1, 0);\n",
+		"puts.lv":    "puts(\"hello\", 1 + 2);\n",
+	})
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	tests := map[string]struct {
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		"no_command": {
+			code:   exitUsage,
+			stderr: usage,
+		},
+		"help": {
+			args:   []string{"help"},
+			code:   exitOK,
+			stdout: usage,
+		},
+		"unknown_command": {
+			args:   []string{"nope"},
+			code:   exitUsage,
+			stderr: "lang_vm: unknown command nope\n\n" + usage,
+		},
+		"run": {
+			args: []string{"run", file("ok.lv")},
+			code: exitOK,
+		},
+		"run_puts": {
+			args:   []string{"run", file("puts.lv")},
+			code:   exitOK,
+			stdout: "hello\n3\n",
+		},
+		"run_missing_file": {
+			args:   []string{"run", file("missing.lv")},
+			code:   exitFailure,
+			stderr: "lang_vm: open " + file("missing.lv") + ": no such file or directory\n",
+		},
+		"run_without_file": {
+			args:   []string{"run"},
+			code:   exitUsage,
+			stderr: "usage: lang_vm run: expected one file, got 0 arguments\n",
+		},
+		"run_runtime_error": {
+			args:   []string{"run", file("runtime.lv")},
+			code:   exitFailure,
+			stderr: "runtime error: division by zero: 1 / 0 (OpDiv at 4)\n  at div (" + file("runtime.lv") + ":2:3)\n      a / b\n  at <main> (" + file("runtime.lv") + ":4:1)\n      div(1, 0);\n",
+		},
+		"ast": {
+			args:   []string{"ast", file("ok.lv")},
+			code:   exitOK,
+			stdout: "let add = fn(a, b) \n{\n\n\t(a + b)\n}\n;\nadd(1, 2)\n",
+		},
+		"ast_syntax_error": {
+			args:   []string{"ast", file("syntax.lv")},
+			code:   exitFailure,
+			stderr: "error[P001]: expected next token to be Identifier, got = instead\n --> " + file("syntax.lv") + ":1:5\n  |\n1 | let = 1;\n  |     ^\n",
+		},
+		"check": {
+			args: []string{"check", file("ok.lv"), file("runtime.lv")},
+			code: exitOK,
+		},
+		"check_reports_every_file": {
+			args: []string{"check", file("compile.lv"), file("ok.lv"), file("syntax.lv")},
+			code: exitFailure,
+			stderr: "error[C001]: undefined variable x\n --> " + file("compile.lv") + ":1:1\n  |\n1 | x;\n  | ^\n\n" +
+				"error[C001]: undefined variable y\n --> " + file("compile.lv") + ":3:10\n  |\n3 |   return y;\n  |          ^\n" +
+				"error[P001]",
+		},
+		"disasm": {
+			args: []string{"disasm", file("ok.lv")},
+			code: exitOK,
+			stdout: `<main>:
+0000 OpClosure 0 0
+0004 OpSetGlobal 0
+0007 OpGetGlobal 0
+0010 OpConstant 1
+0013 OpConstant 2
+0016 OpCall 2
+0018 OpPop
+
+constant 0: CompiledFunction add, 2 parameters, 2 locals
+0000 OpGetLocal 0
+0002 OpGetLocal 1
+0004 OpAdd
+0005 OpReturnValue
+
+constant 1: Integer 1
+
+constant 2: Integer 2
+`,
+		},
+		"disasm_source": {
+			args: []string{"disasm", "-source", file("runtime.lv")},
+			code: exitOK,
+			stdout: `<main>:
+   1 | let div = fn(a, b) {
+0000 OpClosure 0 0
+0004 OpSetGlobal 0
+   4 | div(1, 0);
+0007 OpGetGlobal 0
+0010 OpConstant 1
+0013 OpConstant 2
+0016 OpCall 2
+0018 OpPop
+
+constant 0: CompiledFunction div, 2 parameters, 2 locals
+   2 |   a / b
+0000 OpGetLocal 0
+0002 OpGetLocal 1
+0004 OpDiv
+0005 OpReturnValue
+
+constant 1: Integer 1
+
+constant 2: Integer 0
+`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := runCommand(tc.args, strings.NewReader(""), &stdout, &stderr)
+
+			assert.Equal(t, tc.code, code)
+			assert.Equal(t, tc.stdout, stdout.String())
+			assert.True(t, strings.HasPrefix(stderr.String(), tc.stderr), "stderr: %s", stderr.String())
+		})
+	}
+}
+
+func TestBuildExec(t *testing.T) {
+	dir := writeScripts(t, map[string]string{
+		"ok.lv":      "let add = fn(a, b) { a + b };\nadd(1, 2);\n",
+		"runtime.lv": "let div = fn(a, b) {\n  a / b\n};\ndiv(1, 0);\n",
+	})
+
+	var stdout, stderr bytes.Buffer
+	run := func(args ...string) int {
+		stdout.Reset()
+		stderr.Reset()
+		return runCommand(args, strings.NewReader(""), &stdout, &stderr)
+	}
+
+	assert.Equal(t, exitOK, run("build", filepath.Join(dir, "ok.lv")))
+	assert.FileExists(t, filepath.Join(dir, "ok.lvb"))
+	assert.Equal(t, exitOK, run("exec", filepath.Join(dir, "ok.lvb")))
+
+	out := filepath.Join(dir, "div.bin")
+	assert.Equal(t, exitOK, run("build", "-o", out, filepath.Join(dir, "runtime.lv")))
+	assert.Equal(t, exitFailure, run("exec", out))
+	assert.Equal(t, "runtime error: division by zero: 1 / 0 (OpDiv at 4)\n  at div (2:3)\n  at <main> (4:1)\n", stderr.String())
+
+	assert.Equal(t, exitOK, run("disasm", filepath.Join(dir, "ok.lvb")))
+	assert.True(t, strings.HasPrefix(stdout.String(), "<main>:\n0000 OpClosure 0 0\n"), stdout.String())
+
+	assert.Equal(t, exitFailure, run("disasm", "-source", filepath.Join(dir, "ok.lvb")))
+	assert.Equal(t, exitFailure, run("exec", filepath.Join(dir, "ok.lv")))
+	assert.Contains(t, stderr.String(), "invalid byte code")
+}
+
+func TestRepl(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := runCommand([]string{"repl"}, strings.NewReader("let a = 2;\na * 21\n"), &stdout, &stderr)
+
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, ">> >> 42\n>> \n", stdout.String())
+}
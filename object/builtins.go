@@ -0,0 +1,236 @@
+package object
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MaxBuiltins is bounded by the one byte operand of OpGetBuiltin.
+const MaxBuiltins = 256
+
+// BuiltinFunction is a function implemented by the host. It reports
+// failures by returning an *Error, and may return nil for null.
+type BuiltinFunction func(args ...Object) Object
+
+// OutputFunction is a builtin that prints, like puts. It writes to out,
+// the output the host set for the run, rather than to os.Stdout.
+type OutputFunction func(out io.Writer, args ...Object) Object
+
+// Builtin is a host function. Exactly one of Fn and Output is set.
+type Builtin struct {
+	Name   string
+	Fn     BuiltinFunction
+	Output OutputFunction
+}
+
+func (b *Builtin) Type() Type {
+	return BuiltinObj
+}
+
+func (b *Builtin) Inspect() string {
+	return fmt.Sprintf("builtin %s", b.Name)
+}
+
+// Error is the value a builtin returns to fail the running script.
+type Error struct {
+	Message string
+}
+
+func NewError(format string, a ...interface{}) *Error {
+	return &Error{Message: fmt.Sprintf(format, a...)}
+}
+
+func (e *Error) Type() Type {
+	return ErrorObj
+}
+
+func (e *Error) Inspect() string {
+	return "error: " + e.Message
+}
+
+// The builtin registry is append only: the index a builtin is registered
+// at is baked into compiled bytecode, so it must never change.
+var registry = struct {
+	sync.RWMutex
+	builtins []*Builtin
+	index    map[string]int
+}{index: make(map[string]int)}
+
+// RegisterBuiltin makes fn callable from scripts under name. Builtins have
+// to be registered before the scripts using them are compiled.
+func RegisterBuiltin(name string, fn BuiltinFunction) error {
+	if fn == nil {
+		return fmt.Errorf("builtin %s has no function", name)
+	}
+
+	return register(&Builtin{Name: name, Fn: fn})
+}
+
+// RegisterOutputBuiltin is RegisterBuiltin for builtins that print.
+func RegisterOutputBuiltin(name string, fn OutputFunction) error {
+	if fn == nil {
+		return fmt.Errorf("builtin %s has no function", name)
+	}
+
+	return register(&Builtin{Name: name, Output: fn})
+}
+
+func register(builtin *Builtin) error {
+	name := builtin.Name
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.index[name]; ok {
+		return fmt.Errorf("builtin %s is already registered", name)
+	}
+
+	if len(registry.builtins) >= MaxBuiltins {
+		return fmt.Errorf("too many builtins: at most %d are allowed", MaxBuiltins)
+	}
+
+	registry.index[name] = len(registry.builtins)
+	registry.builtins = append(registry.builtins, builtin)
+
+	return nil
+}
+
+// LookupBuiltin returns the index of the builtin registered under name.
+func LookupBuiltin(name string) (int, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	idx, ok := registry.index[name]
+
+	return idx, ok
+}
+
+// GetBuiltin returns the builtin registered at idx.
+func GetBuiltin(idx int) (*Builtin, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	if idx < 0 || idx >= len(registry.builtins) {
+		return nil, false
+	}
+
+	return registry.builtins[idx], true
+}
+
+func init() {
+	defaults := []*Builtin{
+		{Name: "len", Fn: builtinLen},
+		{Name: "puts", Output: builtinPuts},
+		{Name: "first", Fn: builtinFirst},
+		{Name: "last", Fn: builtinLast},
+		{Name: "rest", Fn: builtinRest},
+		{Name: "push", Fn: builtinPush},
+	}
+
+	for _, builtin := range defaults {
+		if err := register(builtin); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func builtinLen(args ...Object) Object {
+	if len(args) != 1 {
+		return NewError("wrong number of arguments to len: want=1, got=%d", len(args))
+	}
+
+	switch arg := args[0].(type) {
+	case *String:
+		return &Integer{Value: int64(len(arg.Value))}
+	case *Array:
+		return &Integer{Value: int64(len(arg.Elements))}
+	case *Hash:
+		return &Integer{Value: int64(len(arg.Keys))}
+	default:
+		return NewError("argument to len not supported: %s", arg.Type())
+	}
+}
+
+func builtinPuts(out io.Writer, args ...Object) Object {
+	for _, arg := range args {
+		fmt.Fprintln(out, arg.Inspect())
+	}
+
+	return nil
+}
+
+func builtinFirst(args ...Object) Object {
+	array, err := arrayArgument("first", args)
+	if err != nil {
+		return err
+	}
+
+	if len(array.Elements) == 0 {
+		return nil
+	}
+
+	return array.Elements[0]
+}
+
+func builtinLast(args ...Object) Object {
+	array, err := arrayArgument("last", args)
+	if err != nil {
+		return err
+	}
+
+	if len(array.Elements) == 0 {
+		return nil
+	}
+
+	return array.Elements[len(array.Elements)-1]
+}
+
+// builtinRest returns a new array without the first element.
+func builtinRest(args ...Object) Object {
+	array, err := arrayArgument("rest", args)
+	if err != nil {
+		return err
+	}
+
+	if len(array.Elements) == 0 {
+		return nil
+	}
+
+	elements := make([]Object, len(array.Elements)-1)
+	copy(elements, array.Elements[1:])
+
+	return &Array{Elements: elements}
+}
+
+// builtinPush returns a new array with the element appended, arrays are
+// never modified in place.
+func builtinPush(args ...Object) Object {
+	if len(args) != 2 {
+		return NewError("wrong number of arguments to push: want=2, got=%d", len(args))
+	}
+
+	array, err := arrayArgument("push", args[:1])
+	if err != nil {
+		return err
+	}
+
+	elements := make([]Object, len(array.Elements)+1)
+	copy(elements, array.Elements)
+	elements[len(array.Elements)] = args[1]
+
+	return &Array{Elements: elements}
+}
+
+func arrayArgument(name string, args []Object) (*Array, *Error) {
+	if len(args) != 1 {
+		return nil, NewError("wrong number of arguments to %s: want=1, got=%d", name, len(args))
+	}
+
+	array, ok := args[0].(*Array)
+	if !ok {
+		return nil, NewError("argument to %s must be Array, got %s", name, args[0].Type())
+	}
+
+	return array, nil
+}
@@ -0,0 +1,41 @@
+package object
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestRegisterBuiltin(t *testing.T) {
+	fn := func(args ...Object) Object { return nil }
+
+	assert.NoError(t, RegisterBuiltin("testRegisterBuiltin", fn))
+
+	idx, ok := LookupBuiltin("testRegisterBuiltin")
+	assert.True(t, ok)
+
+	builtin, ok := GetBuiltin(idx)
+	assert.True(t, ok)
+	assert.Equal(t, "testRegisterBuiltin", builtin.Name)
+
+	assert.EqualError(t, RegisterBuiltin("testRegisterBuiltin", fn), "builtin testRegisterBuiltin is already registered")
+	assert.EqualError(t, RegisterBuiltin("len", fn), "builtin len is already registered")
+	assert.EqualError(t, RegisterBuiltin("noop", nil), "builtin noop has no function")
+	assert.EqualError(t, RegisterOutputBuiltin("puts", func(out io.Writer, args ...Object) Object { return nil }), "builtin puts is already registered")
+	assert.EqualError(t, RegisterOutputBuiltin("noop", nil), "builtin noop has no function")
+
+	_, ok = LookupBuiltin("unknown")
+	assert.False(t, ok)
+
+	_, ok = GetBuiltin(-1)
+	assert.False(t, ok)
+}
+
+func TestDefaultBuiltins(t *testing.T) {
+	// compiled bytecode refers to builtins by index, so the order is fixed
+	for i, name := range []string{"len", "puts", "first", "last", "rest", "push"} {
+		idx, ok := LookupBuiltin(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, i, idx, name)
+	}
+}
@@ -1,6 +1,11 @@
 package object
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"lang_vm/code"
+	"strings"
+)
 
 const (
 	IntegerObj          = "Integer"
@@ -24,6 +29,20 @@ type Object interface {
 	Inspect() string
 }
 
+// HashKey identifies a hash map key. Keys of different types never collide,
+// so 1 and "1" are distinct keys. Strings are keyed by their text rather than
+// a hash of it, so two strings are the same key only if they are equal.
+type HashKey struct {
+	Type  Type
+	Value uint64
+	Text  string
+}
+
+// Hashable is implemented by the objects that can be used as hash map keys.
+type Hashable interface {
+	HashKey() HashKey
+}
+
 type Integer struct {
 	Value int64
 }
@@ -35,3 +54,164 @@ func (i *Integer) Type() Type {
 func (i *Integer) Inspect() string {
 	return fmt.Sprintf("%d", i.Value)
 }
+
+func (i *Integer) HashKey() HashKey {
+	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
+}
+
+type Boolean struct {
+	Value bool
+}
+
+func (b *Boolean) Type() Type {
+	return BooleanObj
+}
+
+func (b *Boolean) Inspect() string {
+	return fmt.Sprintf("%t", b.Value)
+}
+
+func (b *Boolean) HashKey() HashKey {
+	var value uint64
+	if b.Value {
+		value = 1
+	}
+
+	return HashKey{Type: b.Type(), Value: value}
+}
+
+type String struct {
+	Value string
+}
+
+func (s *String) Type() Type {
+	return StringObj
+}
+
+func (s *String) Inspect() string {
+	return s.Value
+}
+
+func (s *String) HashKey() HashKey {
+	return HashKey{Type: s.Type(), Text: s.Value}
+}
+
+type Null struct{}
+
+func (n *Null) Type() Type {
+	return NullObj
+}
+
+func (n *Null) Inspect() string {
+	return "null"
+}
+
+type CompiledFunction struct {
+	Instructions  code.Instructions
+	NumLocals     int
+	NumParameters int
+
+	// Name is the name the function was bound to by a let statement, if
+	// any. Positions maps its instructions back to the source.
+	Name      string
+	Positions code.PositionTable
+}
+
+func (cf *CompiledFunction) Type() Type {
+	return CompiledFunctionObj
+}
+
+func (cf *CompiledFunction) Inspect() string {
+	return fmt.Sprintf("CompiledFunction[%p]", cf)
+}
+
+// Closure is a compiled function together with the free variables it
+// captured when it was created.
+type Closure struct {
+	Fn   *CompiledFunction
+	Free []Object
+}
+
+func (c *Closure) Type() Type {
+	return ClosureObj
+}
+
+func (c *Closure) Inspect() string {
+	return fmt.Sprintf("Closure[%p]", c)
+}
+
+type Array struct {
+	Elements []Object
+}
+
+func (a *Array) Type() Type {
+	return ArrayObj
+}
+
+func (a *Array) Inspect() string {
+	var out bytes.Buffer
+
+	elements := make([]string, 0, len(a.Elements))
+	for _, e := range a.Elements {
+		elements = append(elements, e.Inspect())
+	}
+
+	out.WriteString("[")
+	out.WriteString(strings.Join(elements, ", "))
+	out.WriteString("]")
+
+	return out.String()
+}
+
+type HashPair struct {
+	Key   Object
+	Value Object
+}
+
+// Hash is a hash map. Keys records the order in which keys were first
+// inserted, which is the order Inspect prints the pairs in.
+type Hash struct {
+	Pairs map[HashKey]HashPair
+	Keys  []HashKey
+}
+
+func NewHash() *Hash {
+	return &Hash{Pairs: make(map[HashKey]HashPair)}
+}
+
+// Set stores value under key. Setting an existing key replaces its value
+// but keeps its position.
+func (h *Hash) Set(key Hashable, value Object) {
+	hashKey := key.HashKey()
+	if _, ok := h.Pairs[hashKey]; !ok {
+		h.Keys = append(h.Keys, hashKey)
+	}
+
+	h.Pairs[hashKey] = HashPair{Key: key.(Object), Value: value}
+}
+
+func (h *Hash) Get(key Hashable) (Object, bool) {
+	pair, ok := h.Pairs[key.HashKey()]
+
+	return pair.Value, ok
+}
+
+func (h *Hash) Type() Type {
+	return HashObj
+}
+
+func (h *Hash) Inspect() string {
+	var out bytes.Buffer
+
+	pairs := make([]string, 0, len(h.Keys))
+	for _, key := range h.Keys {
+		pair := h.Pairs[key]
+		pairs = append(pairs, fmt.Sprintf("%s: %s", pair.Key.Inspect(), pair.Value.Inspect()))
+	}
+
+	out.WriteString("{")
+	out.WriteString(strings.Join(pairs, ", "))
+	out.WriteString("}")
+
+	return out.String()
+}
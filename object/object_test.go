@@ -0,0 +1,28 @@
+package object
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHashStringKeys(t *testing.T) {
+	hash := NewHash()
+	hash.Set(&String{Value: "a"}, &Integer{Value: 1})
+	hash.Set(&String{Value: "b"}, &Integer{Value: 2})
+	hash.Set(&Integer{Value: 1}, &Integer{Value: 3})
+	hash.Set(&String{Value: "a"}, &Integer{Value: 4})
+
+	assert.Equal(t, "{a: 4, b: 2, 1: 3}", hash.Inspect())
+
+	value, ok := hash.Get(&String{Value: "b"})
+	assert.True(t, ok)
+	assert.Equal(t, &Integer{Value: 2}, value)
+
+	_, ok = hash.Get(&String{Value: "1"})
+	assert.False(t, ok)
+
+	// keys are compared by value, not by a hash that distinct strings can
+	// share
+	assert.Equal(t, (&String{Value: "key"}).HashKey(), (&String{Value: "key"}).HashKey())
+	assert.NotEqual(t, (&String{Value: "key"}).HashKey(), (&String{Value: "kez"}).HashKey())
+}
@@ -0,0 +1,119 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"lang_vm/token"
+	"strings"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// Diagnostic codes identify the kind of problem independent of the message.
+const (
+	CodeUnexpectedToken   = "P001"
+	CodeNoPrefixParseFn   = "P002"
+	CodeInvalidInteger    = "P003"
+	CodeUnterminatedBlock = "P004"
+	CodeIllegalToken      = "P005"
+)
+
+// Diagnostic is a problem found while parsing, located in the source.
+type Diagnostic struct {
+	Severity Severity
+	Span     token.Span
+	Code     string
+	Message  string
+
+	// Expected lists the token types that would have been valid, Found is
+	// the token that was seen instead. Both are only set for unexpected
+	// token diagnostics.
+	Expected []token.TokenType
+	Found    token.Token
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s[%s]: %s", d.Span.Start, d.Severity, d.Code, d.Message)
+}
+
+// Render formats the diagnostic together with the offending source line and
+// a caret underline of its span. filename may be empty.
+func (d Diagnostic) Render(filename, source string) string {
+	var out bytes.Buffer
+
+	fmt.Fprintf(&out, "%s[%s]: %s\n", d.Severity, d.Code, d.Message)
+
+	location := d.Span.Start.String()
+	if filename != "" {
+		location = filename + ":" + location
+	}
+	fmt.Fprintf(&out, " --> %s\n", location)
+
+	line, ok := token.SourceLine(source, d.Span.Start)
+	if !ok {
+		return out.String()
+	}
+
+	gutter := fmt.Sprintf("%d", d.Span.Start.Line)
+	padding := strings.Repeat(" ", len(gutter))
+
+	fmt.Fprintf(&out, "%s |\n", padding)
+	fmt.Fprintf(&out, "%s | %s\n", gutter, line)
+	fmt.Fprintf(&out, "%s | %s\n", padding, underline(line, d.Span))
+
+	return out.String()
+}
+
+// RenderDiagnostics renders all diagnostics, separated by blank lines.
+func RenderDiagnostics(filename, source string, diagnostics []Diagnostic) string {
+	rendered := make([]string, 0, len(diagnostics))
+	for _, d := range diagnostics {
+		rendered = append(rendered, d.Render(filename, source))
+	}
+
+	return strings.Join(rendered, "\n")
+}
+
+// underline returns the caret marker for span under line. Tabs before the
+// span are kept so that the carets line up with the source.
+func underline(line string, span token.Span) string {
+	column := span.Start.Column - 1
+	if column > len(line) {
+		column = len(line)
+	}
+
+	var out strings.Builder
+	for _, ch := range []byte(line[:column]) {
+		if ch == '\t' {
+			out.WriteByte('\t')
+		} else {
+			out.WriteByte(' ')
+		}
+	}
+
+	width := 1
+	if span.End.Line == span.Start.Line && span.End.Offset > span.Start.Offset {
+		width = span.End.Offset - span.Start.Offset
+	} else if span.End.Line > span.Start.Line && len(line) > column {
+		width = len(line) - column
+	}
+	out.WriteString(strings.Repeat("^", width))
+
+	return out.String()
+}
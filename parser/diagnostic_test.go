@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"github.com/stretchr/testify/assert"
+	"lang_vm/lexer"
+	"lang_vm/token"
+	"testing"
+)
+
+func TestDiagnostics(t *testing.T) {
+	input := "let x 5;"
+
+	p := New(lexer.New(input))
+	p.ParseProgram()
+
+	diagnostics := p.Diagnostics()
+	assert.NotEmpty(t, diagnostics)
+
+	d := diagnostics[0]
+	assert.Equal(t, SeverityError, d.Severity)
+	assert.Equal(t, CodeUnexpectedToken, d.Code)
+	assert.Equal(t, "expected next token to be =, got Int instead", d.Message)
+	assert.Equal(t, []token.TokenType{token.Assign}, d.Expected)
+	assert.Equal(t, token.TokenType(token.Int), d.Found.Type)
+	assert.Equal(t, "1:7-1:8", d.Span.String())
+	assert.Equal(t, "1:7: error[P001]: expected next token to be =, got Int instead", d.String())
+
+	assert.Equal(t, d.Message, p.Errors()[0])
+}
+
+func TestDiagnosticRender(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		filename string
+		expected string
+	}{
+		"unexpected_token": {
+			input:    "let a = 1;\nlet b 22;\n",
+			filename: "main.lv",
+			expected: "error[P001]: expected next token to be =, got Int instead\n" +
+				" --> main.lv:2:7\n" +
+				"  |\n" +
+				"2 | let b 22;\n" +
+				"  |       ^^\n",
+		},
+		"tabs_are_kept": {
+			input: "if (true) {\n\t\t) }",
+			expected: "error[P002]: no prefix parse function for ) found\n" +
+				" --> 2:3\n" +
+				"  |\n" +
+				"2 | \t\t) }\n" +
+				"  | \t\t^\n",
+		},
+		"unterminated_string": {
+			input: "let s = \"abc;",
+			expected: "error[P005]: illegal token \"\\\"abc;\"\n" +
+				" --> 1:9\n" +
+				"  |\n" +
+				"1 | let s = \"abc;\n" +
+				"  |         ^^^^^\n",
+		},
+		"end_of_input": {
+			input: "let a =",
+			expected: "error[P002]: no prefix parse function for EOF found\n" +
+				" --> 1:8\n" +
+				"  |\n" +
+				"1 | let a =\n" +
+				"  |        ^\n",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := New(lexer.New(tc.input))
+			p.ParseProgram()
+
+			diagnostics := p.Diagnostics()
+			assert.NotEmpty(t, diagnostics)
+			assert.Equal(t, tc.expected, diagnostics[0].Render(tc.filename, tc.input))
+		})
+	}
+}
@@ -21,16 +21,18 @@ const (
 )
 
 var precedences = map[token.TokenType]int{
-	token.Equal:       Equals,
-	token.NotEqual:    Equals,
-	token.LessThan:    LessOrGreater,
-	token.GreaterThan: LessOrGreater,
-	token.Plus:        Sum,
-	token.Minus:       Sum,
-	token.Slash:       Product,
-	token.Asterisk:    Product,
-	token.LeftParen:   Call,
-	token.LeftBracket: Index,
+	token.Equal:              Equals,
+	token.NotEqual:           Equals,
+	token.LessThan:           LessOrGreater,
+	token.GreaterThan:        LessOrGreater,
+	token.LessThanOrEqual:    LessOrGreater,
+	token.GreaterThanOrEqual: LessOrGreater,
+	token.Plus:               Sum,
+	token.Minus:              Sum,
+	token.Slash:              Product,
+	token.Asterisk:           Product,
+	token.LeftParen:          Call,
+	token.LeftBracket:        Index,
 }
 
 type (
@@ -39,8 +41,8 @@ type (
 )
 
 type Parser struct {
-	l      lexer.ILexer
-	errors []string
+	l           lexer.ILexer
+	diagnostics []Diagnostic
 
 	currentToken token.Token
 	peekToken    token.Token
@@ -50,17 +52,36 @@ type Parser struct {
 }
 
 func New(l lexer.ILexer) *Parser {
-	p := &Parser{l: l, errors: []string{}}
+	p := &Parser{l: l, diagnostics: []Diagnostic{}}
 
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
+	p.prefixParseFns[token.Identifier] = p.parseIdentifier
 	p.prefixParseFns[token.Int] = p.parseIntegerLiteral
+	p.prefixParseFns[token.String] = p.parseStringLiteral
+	p.prefixParseFns[token.Illegal] = p.parseIllegal
+	p.prefixParseFns[token.Minus] = p.parsePrefixExpression
+	p.prefixParseFns[token.Bang] = p.parsePrefixExpression
+	p.prefixParseFns[token.True] = p.parseBoolean
+	p.prefixParseFns[token.False] = p.parseBoolean
 	p.prefixParseFns[token.If] = p.parseIfExpression
+	p.prefixParseFns[token.LeftParen] = p.parseGroupedExpression
+	p.prefixParseFns[token.Function] = p.parseFunctionLiteral
+	p.prefixParseFns[token.LeftBracket] = p.parseArrayLiteral
+	p.prefixParseFns[token.LeftBrace] = p.parseHashLiteral
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.infixParseFns[token.Plus] = p.parseInfixExpression
 	p.infixParseFns[token.Minus] = p.parseInfixExpression
 	p.infixParseFns[token.Slash] = p.parseInfixExpression
 	p.infixParseFns[token.Asterisk] = p.parseInfixExpression
+	p.infixParseFns[token.Equal] = p.parseInfixExpression
+	p.infixParseFns[token.NotEqual] = p.parseInfixExpression
+	p.infixParseFns[token.LessThan] = p.parseInfixExpression
+	p.infixParseFns[token.GreaterThan] = p.parseInfixExpression
+	p.infixParseFns[token.LessThanOrEqual] = p.parseInfixExpression
+	p.infixParseFns[token.GreaterThanOrEqual] = p.parseInfixExpression
+	p.infixParseFns[token.LeftParen] = p.parseCallExpression
+	p.infixParseFns[token.LeftBracket] = p.parseIndexExpression
 
 	// Read two tokens, so currentToken and peekToken are both set
 	p.nextToken()
@@ -69,12 +90,33 @@ func New(l lexer.ILexer) *Parser {
 	return p
 }
 
+// Errors returns the messages of all diagnostics reported so far.
 func (p *Parser) Errors() []string {
-	return p.errors
+	errors := make([]string, 0, len(p.diagnostics))
+	for _, d := range p.diagnostics {
+		errors = append(errors, d.Message)
+	}
+
+	return errors
+}
+
+// Diagnostics returns all problems reported so far, in source order.
+func (p *Parser) Diagnostics() []Diagnostic {
+	return p.diagnostics
+}
+
+func (p *Parser) report(d Diagnostic) {
+	p.diagnostics = append(p.diagnostics, d)
 }
 
 func (p *Parser) nextToken() {
 	p.currentToken = p.peekToken
+
+	// never read past the end of the input
+	if p.currentToken.Type == token.EOF {
+		return
+	}
+
 	p.peekToken = p.l.NextToken()
 }
 
@@ -119,10 +161,12 @@ func (p *Parser) ParseProgram() *ast.Program {
 		Statements: []ast.Statement{},
 	}
 
-	for p.peekToken.Type != token.EOF {
+	for !p.currentTokenIs(token.EOF) {
 		stmt := p.ParseStatement()
 		if stmt != nil {
 			program.Statements = append(program.Statements, stmt)
+		} else {
+			p.synchronize()
 		}
 
 		p.nextToken()
@@ -131,16 +175,100 @@ func (p *Parser) ParseProgram() *ast.Program {
 	return &program
 }
 
+// synchronize skips the rest of a statement that failed to parse, so that
+// parsing can resume with the next statement instead of reporting errors
+// that follow from the first one. It stops on a ';' that ends the broken
+// statement, or before a '}' or a token that starts a new statement.
+func (p *Parser) synchronize() {
+	for !p.currentTokenIs(token.EOF) && !p.currentTokenIs(token.RightBrace) {
+		if p.currentTokenIs(token.Semicolon) {
+			return
+		}
+
+		switch p.peekToken.Type {
+		case token.Let, token.Return, token.RightBrace, token.EOF:
+			return
+		}
+
+		p.nextToken()
+	}
+}
+
 func (p *Parser) ParseStatement() ast.Statement {
-	return p.parseExpressionStatement()
+	switch p.currentToken.Type {
+	case token.Let:
+		return p.parseLetStatement()
+	case token.Return:
+		return p.parseReturnStatement()
+	default:
+		// avoid returning a nil *ast.ExpressionStatement as a non-nil Statement
+		if stmt := p.parseExpressionStatement(); stmt != nil {
+			return stmt
+		}
+		return nil
+	}
+}
+
+func (p *Parser) parseLetStatement() ast.Statement {
+	stmt := &ast.LetStatement{Token: p.currentToken}
+
+	if !p.expectPeek(token.Identifier) {
+		return nil
+	}
+
+	stmt.Name = &ast.Identifier{Token: p.currentToken, Value: p.currentToken.Literal}
+
+	if !p.expectPeek(token.Assign) {
+		return nil
+	}
+
+	p.nextToken()
+	stmt.Value = p.parseExpression(Lowest)
+	if stmt.Value == nil {
+		return nil
+	}
+
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok {
+		fl.Name = stmt.Name.Value
+	}
+
+	if p.peekTokenIs(token.Semicolon) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseReturnStatement() ast.Statement {
+	stmt := &ast.ReturnStatement{Token: p.currentToken}
+
+	p.nextToken()
+	stmt.ReturnValue = p.parseExpression(Lowest)
+	if stmt.ReturnValue == nil {
+		return nil
+	}
+
+	if p.peekTokenIs(token.Semicolon) {
+		p.nextToken()
+	}
+
+	return stmt
 }
 
 func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
-	tok := p.currentToken
-	return &ast.ExpressionStatement{
-		Token:      tok,
-		Expression: p.parseExpression(Lowest),
+	// the token has to be taken before parsing the expression advances it
+	stmt := &ast.ExpressionStatement{Token: p.currentToken}
+
+	stmt.Expression = p.parseExpression(Lowest)
+	if stmt.Expression == nil {
+		return nil
+	}
+
+	if p.peekTokenIs(token.Semicolon) {
+		p.nextToken()
 	}
+
+	return stmt
 }
 
 func (p *Parser) parseExpression(precedence int) ast.Expression {
@@ -152,7 +280,7 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 
 	leftExp := prefix()
 
-	for !p.peekTokenIs(token.Semicolon) && precedence < p.peekPrecedence() {
+	for leftExp != nil && !p.peekTokenIs(token.Semicolon) && precedence < p.peekPrecedence() {
 		infix := p.infixParseFns[p.peekToken.Type]
 		if infix == nil {
 			return leftExp
@@ -166,13 +294,39 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 }
 
 func (p *Parser) peekError(t token.TokenType) {
-	msg := fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+	p.report(Diagnostic{
+		Severity: SeverityError,
+		Span:     p.peekToken.Span,
+		Code:     CodeUnexpectedToken,
+		Message:  fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type),
+		Expected: []token.TokenType{t},
+		Found:    p.peekToken,
+	})
 }
 
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
-	msg := fmt.Sprintf("no prefix parse function for %s found", t)
-	p.errors = append(p.errors, msg)
+	p.report(Diagnostic{
+		Severity: SeverityError,
+		Span:     p.currentToken.Span,
+		Code:     CodeNoPrefixParseFn,
+		Message:  fmt.Sprintf("no prefix parse function for %s found", t),
+		Found:    p.currentToken,
+	})
+}
+
+func (p *Parser) unterminatedBlockError(open token.Token) {
+	p.report(Diagnostic{
+		Severity: SeverityError,
+		Span:     p.currentToken.Span,
+		Code:     CodeUnterminatedBlock,
+		Message:  fmt.Sprintf("expected } to close block opened at %s, got %s instead", open.Span.Start, p.currentToken.Type),
+		Expected: []token.TokenType{token.RightBrace},
+		Found:    p.currentToken,
+	})
+}
+
+func (p *Parser) parseIdentifier() ast.Expression {
+	return &ast.Identifier{Token: p.currentToken, Value: p.currentToken.Literal}
 }
 
 func (p *Parser) parseIntegerLiteral() ast.Expression {
@@ -180,8 +334,13 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 
 	value, err := strconv.ParseInt(p.currentToken.Literal, 0, 64)
 	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as integer", p.currentToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.report(Diagnostic{
+			Severity: SeverityError,
+			Span:     p.currentToken.Span,
+			Code:     CodeInvalidInteger,
+			Message:  fmt.Sprintf("could not parse %q as integer", p.currentToken.Literal),
+			Found:    p.currentToken,
+		})
 		return nil
 	}
 
@@ -189,6 +348,54 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	return lit
 }
 
+func (p *Parser) parseStringLiteral() ast.Expression {
+	return &ast.StringLiteral{Token: p.currentToken, Value: p.currentToken.Literal}
+}
+
+// parseIllegal reports a token the lexer could not make sense of, such as an
+// unterminated string literal.
+func (p *Parser) parseIllegal() ast.Expression {
+	p.report(Diagnostic{
+		Severity: SeverityError,
+		Span:     p.currentToken.Span,
+		Code:     CodeIllegalToken,
+		Message:  fmt.Sprintf("illegal token %q", p.currentToken.Literal),
+		Found:    p.currentToken,
+	})
+
+	return nil
+}
+
+func (p *Parser) parseBoolean() ast.Expression {
+	return &ast.Boolean{Token: p.currentToken, Value: p.currentTokenIs(token.True)}
+}
+
+func (p *Parser) parseGroupedExpression() ast.Expression {
+	p.nextToken()
+
+	exp := p.parseExpression(Lowest)
+	if exp == nil || !p.expectPeek(token.RightParen) {
+		return nil
+	}
+
+	return exp
+}
+
+func (p *Parser) parsePrefixExpression() ast.Expression {
+	expression := &ast.PrefixExpression{
+		Token:    p.currentToken,
+		Operator: p.currentToken.Literal,
+	}
+
+	p.nextToken()
+	expression.Right = p.parseExpression(Prefix)
+	if expression.Right == nil {
+		return nil
+	}
+
+	return expression
+}
+
 func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	expression := &ast.BinaryExpression{
 		Token:    p.currentToken,
@@ -199,6 +406,10 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	precedence := p.currentPrecedence()
 	p.nextToken()
 	expression.Right = p.parseExpression(precedence)
+	if expression.Right == nil {
+		return nil
+	}
+
 	return expression
 }
 
@@ -208,15 +419,26 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 
 	p.nextToken()
 
-	for !p.currentTokenIs(token.RightBrace) {
+	for !p.currentTokenIs(token.RightBrace) && !p.currentTokenIs(token.EOF) {
 		stmt := p.ParseStatement()
 		if stmt != nil {
 			block.Statements = append(block.Statements, stmt)
+		} else {
+			p.synchronize()
+			if p.currentTokenIs(token.RightBrace) {
+				break
+			}
 		}
 
 		p.nextToken()
 	}
 
+	if p.currentTokenIs(token.EOF) {
+		p.unterminatedBlockError(block.Token)
+	}
+
+	block.RightBrace = p.currentToken
+
 	return block
 }
 
@@ -230,10 +452,13 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	// get condition
 	p.nextToken()
 	expression.Condition = p.parseExpression(Lowest)
+	if expression.Condition == nil {
+		return nil
+	}
 
-	//if !p.expectPeek(token.RightParen) {
-	//	return nil
-	//}
+	if !p.expectPeek(token.RightParen) {
+		return nil
+	}
 
 	if !p.expectPeek(token.LeftBrace) {
 		return nil
@@ -243,8 +468,8 @@ func (p *Parser) parseIfExpression() ast.Expression {
 
 	if p.peekTokenIs(token.Else) {
 		p.nextToken()
-		if p.peekTokenIs(token.LeftBrace) {
-			p.nextToken()
+		if !p.expectPeek(token.LeftBrace) {
+			return nil
 		}
 
 		expression.Alternative = p.parseBlockStatement()
@@ -252,3 +477,177 @@ func (p *Parser) parseIfExpression() ast.Expression {
 
 	return expression
 }
+
+func (p *Parser) parseFunctionLiteral() ast.Expression {
+	lit := &ast.FunctionLiteral{Token: p.currentToken}
+
+	if !p.expectPeek(token.LeftParen) {
+		return nil
+	}
+
+	lit.Parameters = p.parseFunctionParameters()
+	if lit.Parameters == nil {
+		return nil
+	}
+
+	if !p.expectPeek(token.LeftBrace) {
+		return nil
+	}
+
+	lit.Body = p.parseBlockStatement()
+
+	return lit
+}
+
+func (p *Parser) parseFunctionParameters() []*ast.Identifier {
+	identifiers := []*ast.Identifier{}
+
+	if p.peekTokenIs(token.RightParen) {
+		p.nextToken()
+		return identifiers
+	}
+
+	if !p.expectPeek(token.Identifier) {
+		return nil
+	}
+	identifiers = append(identifiers, &ast.Identifier{Token: p.currentToken, Value: p.currentToken.Literal})
+
+	for p.peekTokenIs(token.Comma) {
+		p.nextToken()
+		if !p.expectPeek(token.Identifier) {
+			return nil
+		}
+		identifiers = append(identifiers, &ast.Identifier{Token: p.currentToken, Value: p.currentToken.Literal})
+	}
+
+	if !p.expectPeek(token.RightParen) {
+		return nil
+	}
+
+	return identifiers
+}
+
+func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
+	exp := &ast.CallExpression{Token: p.currentToken, Function: function}
+
+	exp.Arguments = p.parseExpressionList(token.RightParen)
+	if exp.Arguments == nil {
+		return nil
+	}
+	exp.RightParen = p.currentToken
+
+	return exp
+}
+
+func (p *Parser) parseArrayLiteral() ast.Expression {
+	array := &ast.ArrayLiteral{Token: p.currentToken}
+
+	array.Elements = p.parseExpressionList(token.RightBracket)
+	if array.Elements == nil {
+		return nil
+	}
+	array.RightBracket = p.currentToken
+
+	return array
+}
+
+func (p *Parser) parseHashLiteral() ast.Expression {
+	hash := &ast.HashLiteral{Token: p.currentToken, Pairs: []ast.HashPair{}}
+
+	for !p.peekTokenIs(token.RightBrace) {
+		p.nextToken()
+		key := p.parseExpression(Lowest)
+		if key == nil || !p.expectPeek(token.Colon) {
+			p.skipHashLiteral()
+			return nil
+		}
+
+		p.nextToken()
+		value := p.parseExpression(Lowest)
+		if value == nil {
+			p.skipHashLiteral()
+			return nil
+		}
+
+		hash.Pairs = append(hash.Pairs, ast.HashPair{Key: key, Value: value})
+
+		if !p.peekTokenIs(token.RightBrace) && !p.expectPeek(token.Comma) {
+			p.skipHashLiteral()
+			return nil
+		}
+	}
+
+	p.nextToken()
+	hash.RightBrace = p.currentToken
+
+	return hash
+}
+
+// skipHashLiteral skips the rest of a malformed hash literal up to its
+// closing '}' and a ';' following it. Otherwise synchronize would take
+// that '}' for the end of an enclosing block.
+func (p *Parser) skipHashLiteral() {
+	depth := 0
+	for !p.currentTokenIs(token.EOF) {
+		if p.currentTokenIs(token.RightBrace) {
+			if depth == 0 {
+				break
+			}
+			depth--
+		}
+
+		p.nextToken()
+		if p.currentTokenIs(token.LeftBrace) {
+			depth++
+		}
+	}
+
+	if p.peekTokenIs(token.Semicolon) {
+		p.nextToken()
+	}
+}
+
+func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
+	exp := &ast.IndexExpression{Token: p.currentToken, Left: left}
+
+	p.nextToken()
+	exp.Index = p.parseExpression(Lowest)
+	if exp.Index == nil || !p.expectPeek(token.RightBracket) {
+		return nil
+	}
+	exp.RightBracket = p.currentToken
+
+	return exp
+}
+
+// parseExpressionList parses comma separated expressions up to and
+// including the end token. It returns nil if the list is malformed.
+func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
+	list := []ast.Expression{}
+
+	if p.peekTokenIs(end) {
+		p.nextToken()
+		return list
+	}
+
+	for {
+		p.nextToken()
+
+		exp := p.parseExpression(Lowest)
+		if exp == nil {
+			return nil
+		}
+		list = append(list, exp)
+
+		if !p.peekTokenIs(token.Comma) {
+			break
+		}
+		p.nextToken()
+	}
+
+	if !p.expectPeek(end) {
+		return nil
+	}
+
+	return list
+}
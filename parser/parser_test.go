@@ -3,6 +3,7 @@ package parser
 import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"lang_vm/ast"
 	"lang_vm/lexer"
 	"lang_vm/lexer/mocks"
 	"lang_vm/token"
@@ -69,16 +70,185 @@ func TestExpressionParsing(t *testing.T) {
 
 	{
 		l := &mocks.ILexer{}
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "2"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Asterisk, Literal: "*"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "5"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Plus, Literal: "+"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "3"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.EOF, Literal: ""}).Once()
+
+		testCases["multiply_and_plus_expression"] = testCase{
+			l:           l,
+			expectedOut: "((2 * 5) + 3)",
+		}
+
+	}
+
+	{
+		l := &mocks.ILexer{}
+		l.On("NextToken").Return(token.Token{Type: token.If, Literal: "if"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.LeftParen, Literal: "("}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.True, Literal: "true"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.RightParen, Literal: ")"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.LeftBrace, Literal: "{"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.False, Literal: "false"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.RightBrace, Literal: "}"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.EOF, Literal: ""}).Once()
+
+		testCases["boolean_literals"] = testCase{
+			l:           l,
+			expectedOut: "iftrue \n{\n\n\tfalse\n}\n",
+		}
+
+	}
+
+	{
+		l := &mocks.ILexer{}
+		l.On("NextToken").Return(token.Token{Type: token.Let, Literal: "let"}).Once()
 		l.On("NextToken").Return(token.Token{Type: token.Identifier, Literal: "a"}).Once()
 		l.On("NextToken").Return(token.Token{Type: token.Assign, Literal: "="}).Once()
 		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "5"}).Once()
 		l.On("NextToken").Return(token.Token{Type: token.Asterisk, Literal: "*"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Identifier, Literal: "b"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Semicolon, Literal: ";"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.EOF, Literal: ""}).Once()
+
+		testCases["let_statement"] = testCase{
+			l:           l,
+			expectedOut: "let a = (5 * b);",
+		}
+
+	}
+
+	{
+		l := &mocks.ILexer{}
+		l.On("NextToken").Return(token.Token{Type: token.Function, Literal: "fn"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.LeftParen, Literal: "("}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Identifier, Literal: "x"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Comma, Literal: ","}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Identifier, Literal: "y"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.RightParen, Literal: ")"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.LeftBrace, Literal: "{"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Return, Literal: "return"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Identifier, Literal: "x"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Semicolon, Literal: ";"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.RightBrace, Literal: "}"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.LeftParen, Literal: "("}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "1"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Comma, Literal: ","}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "2"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Asterisk, Literal: "*"}).Once()
 		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "3"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.RightParen, Literal: ")"}).Once()
 		l.On("NextToken").Return(token.Token{Type: token.EOF, Literal: ""}).Once()
 
-		testCases["simple_plus_and_multiply_expression"] = testCase{
+		testCases["function_literal_call"] = testCase{
+			l:           l,
+			expectedOut: "fn(x, y) \n{\n\n\treturn x;\n}\n(1, (2 * 3))",
+		}
+
+	}
+
+	{
+		l := &mocks.ILexer{}
+		l.On("NextToken").Return(token.Token{Type: token.Minus, Literal: "-"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "2"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Asterisk, Literal: "*"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Bang, Literal: "!"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Bang, Literal: "!"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Identifier, Literal: "a"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Minus, Literal: "-"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "3"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.EOF, Literal: ""}).Once()
+
+		testCases["prefix_expression"] = testCase{
 			l:           l,
-			expectedOut: "a = 5 * 3",
+			expectedOut: "(((-2) * (!(!a))) - 3)",
+		}
+
+	}
+
+	{
+		l := &mocks.ILexer{}
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "1"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Plus, Literal: "+"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "2"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.LessThanOrEqual, Literal: "<="}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "3"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Equal, Literal: "=="}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "4"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.GreaterThan, Literal: ">"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "5"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.EOF, Literal: ""}).Once()
+
+		testCases["comparison_precedence"] = testCase{
+			l:           l,
+			expectedOut: "(((1 + 2) <= 3) == (4 > 5))",
+		}
+
+	}
+
+	{
+		l := &mocks.ILexer{}
+		l.On("NextToken").Return(token.Token{Type: token.String, Literal: "a\"b"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Plus, Literal: "+"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.String, Literal: "c"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.EOF, Literal: ""}).Once()
+
+		testCases["string_literals"] = testCase{
+			l:           l,
+			expectedOut: `("a\"b" + "c")`,
+		}
+
+	}
+
+	{
+		l := &mocks.ILexer{}
+		l.On("NextToken").Return(token.Token{Type: token.LeftBracket, Literal: "["}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "1"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Comma, Literal: ","}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "2"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Asterisk, Literal: "*"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "3"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.RightBracket, Literal: "]"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.LeftBracket, Literal: "["}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "1"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Plus, Literal: "+"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "0"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.RightBracket, Literal: "]"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Asterisk, Literal: "*"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "2"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.EOF, Literal: ""}).Once()
+
+		testCases["array_index_precedence"] = testCase{
+			l:           l,
+			expectedOut: "(([1, (2 * 3)][(1 + 0)]) * 2)",
+		}
+
+	}
+
+	{
+		l := &mocks.ILexer{}
+		l.On("NextToken").Return(token.Token{Type: token.LeftBrace, Literal: "{"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.String, Literal: "b"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Colon, Literal: ":"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "1"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Plus, Literal: "+"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "2"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Comma, Literal: ","}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Int, Literal: "1"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Colon, Literal: ":"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.True, Literal: "true"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.Comma, Literal: ","}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.RightBrace, Literal: "}"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.LeftBracket, Literal: "["}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.String, Literal: "b"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.RightBracket, Literal: "]"}).Once()
+		l.On("NextToken").Return(token.Token{Type: token.EOF, Literal: ""}).Once()
+
+		testCases["hash_literal_in_source_order"] = testCase{
+			l:           l,
+			expectedOut: `({"b": (1 + 2), 1: true}["b"])`,
 		}
 
 	}
@@ -90,3 +260,174 @@ func TestExpressionParsing(t *testing.T) {
 		assert.Equal(t, tc.expectedOut, fmt.Sprintf("%v", program), name)
 	}
 }
+
+func TestNodeSpans(t *testing.T) {
+	input := "let add = fn(a, b) {\n  a + b\n};\nif (add(1, -2) > 0) { 1 } else { 0 }"
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	assert.Empty(t, p.Errors())
+	assert.Len(t, program.Statements, 2)
+
+	let := program.Statements[0].(*ast.LetStatement)
+	fn := let.Value.(*ast.FunctionLiteral)
+	sum := fn.Body.Statements[0].(*ast.ExpressionStatement).Expression
+
+	ifExp := program.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.IfExpression)
+	comparison := ifExp.Condition.(*ast.BinaryExpression)
+	call := comparison.Left.(*ast.CallExpression)
+	minus := call.Arguments[1]
+
+	indexProgram := New(lexer.New("[1, 2][-1]")).ParseProgram()
+	index := indexProgram.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.IndexExpression)
+	array := index.Left.(*ast.ArrayLiteral)
+
+	hashProgram := New(lexer.New("let h = {};\n{1: 2}")).ParseProgram()
+	emptyHash := hashProgram.Statements[0].(*ast.LetStatement).Value
+	hash := hashProgram.Statements[1].(*ast.ExpressionStatement).Expression
+
+	tests := map[string]struct {
+		node     ast.Node
+		expected string
+	}{
+		"program":       {program, "1:1-4:37"},
+		"let":           {let, "1:1-3:2"},
+		"let_name":      {let.Name, "1:5-1:8"},
+		"function":      {fn, "1:11-3:2"},
+		"function_body": {fn.Body, "1:20-3:2"},
+		"binary":        {sum, "2:3-2:8"},
+		"if":            {ifExp, "4:1-4:37"},
+		"condition":     {comparison, "4:5-4:19"},
+		"call":          {call, "4:5-4:15"},
+		"prefix":        {minus, "4:12-4:14"},
+		"if_statement":  {program.Statements[1], "4:1-4:37"},
+		"alternative":   {ifExp.Alternative, "4:32-4:37"},
+		"array":         {array, "1:1-1:7"},
+		"index":         {index, "1:1-1:11"},
+		"empty_hash":    {emptyHash, "1:9-1:11"},
+		"hash":          {hash, "2:1-2:7"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.node.Span().String())
+		})
+	}
+
+	assert.Equal(t, 20, let.Value.Span().End.Offset-let.Value.Span().Start.Offset)
+}
+
+func TestErrorRecovery(t *testing.T) {
+	tests := map[string]struct {
+		input      string
+		errors     []string
+		statements []string
+	}{
+		"independent_errors": {
+			input: "let a = ; let b = 2; let = 3; b * 2",
+			errors: []string{
+				"no prefix parse function for ; found",
+				"expected next token to be Identifier, got = instead",
+			},
+			statements: []string{"let b = 2;", "(b * 2)"},
+		},
+		"error_inside_block": {
+			input: "if (true) { 1 + ; 2 } let x = 1;",
+			errors: []string{
+				"no prefix parse function for ; found",
+			},
+			statements: []string{"iftrue \n{\n\n\t2\n}\n", "let x = 1;"},
+		},
+		"error_before_closing_brace": {
+			input: "let f = fn() { 1 + }; f()",
+			errors: []string{
+				"no prefix parse function for } found",
+			},
+			statements: []string{"let f = fn() \n{\n\n}\n;", "f()"},
+		},
+		"missing_closing_paren": {
+			input: "let a = (1 + 2; let b = 3;",
+			errors: []string{
+				"expected next token to be ), got ; instead",
+			},
+			statements: []string{"let b = 3;"},
+		},
+		"unterminated_block": {
+			input: "if (x) { 1",
+			errors: []string{
+				"expected } to close block opened at 1:8, got EOF instead",
+			},
+			statements: []string{"ifx \n{\n\n\t1\n}\n"},
+		},
+		"unterminated_array": {
+			input: "let a = [1, 2; let b = a[0;",
+			errors: []string{
+				"expected next token to be ], got ; instead",
+				"expected next token to be ], got ; instead",
+			},
+			statements: []string{},
+		},
+		"hash_missing_colon": {
+			input: "let h = {1 2}; let b = 3;",
+			errors: []string{
+				"expected next token to be :, got Int instead",
+			},
+			statements: []string{"let b = 3;"},
+		},
+		"hash_missing_comma": {
+			input: "let h = {1: 2 3: 4}; h",
+			errors: []string{
+				"expected next token to be ,, got Int instead",
+			},
+			statements: []string{"h"},
+		},
+		"hash_nested_braces": {
+			input: "let h = {1 fn() { 2 }, 3: {4: 5}}\nlet b = 3;",
+			errors: []string{
+				"expected next token to be :, got Function instead",
+			},
+			statements: []string{"let b = 3;"},
+		},
+		"stray_closing_brace": {
+			input: "} 1; }",
+			errors: []string{
+				"no prefix parse function for } found",
+				"no prefix parse function for } found",
+			},
+			statements: []string{"1"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := New(lexer.New(tc.input))
+			program := p.ParseProgram()
+
+			assert.Equal(t, tc.errors, p.Errors())
+
+			statements := []string{}
+			for _, s := range program.Statements {
+				statements = append(statements, s.String())
+			}
+			assert.Equal(t, tc.statements, statements)
+		})
+	}
+}
+
+func TestTruncatedInputTerminates(t *testing.T) {
+	input := "let add = fn(a, b) { if (a > b) { return a; } else { a + b } }; add(1, (2 * 3));"
+
+	for i := 0; i <= len(input); i++ {
+		p := New(lexer.New(input[:i]))
+		program := p.ParseProgram()
+
+		assert.NotNil(t, program, input[:i])
+		for _, s := range program.Statements {
+			assert.NotNil(t, s, input[:i])
+			assert.NotPanics(t, func() {
+				_ = s.String()
+				_ = s.Span()
+			}, input[:i])
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Package repl implements the interactive read-eval-print loop.
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"lang_vm/ast"
+	"lang_vm/code"
+	"lang_vm/compiler"
+	"lang_vm/lexer"
+	"lang_vm/object"
+	"lang_vm/parser"
+	"lang_vm/token"
+	"lang_vm/vm"
+	"os"
+	"strings"
+)
+
+const (
+	Prompt             = ">> "
+	ContinuationPrompt = ".. "
+
+	// filename is shown in error locations.
+	filename = "<repl>"
+)
+
+const help = `:ast          print the syntax tree of the last entry
+:bytecode     print the byte code of the last entry
+:load <file>  evaluate a file
+:reset        forget all definitions
+:quit         leave the REPL
+`
+
+// REPL evaluates entries one after another. Every entry is compiled against
+// the symbol table and constant pool left by the previous ones and runs
+// with the same globals, so definitions carry over.
+type REPL struct {
+	out io.Writer
+
+	symbols   *compiler.SymbolTable
+	constants []object.Object
+	globals   []object.Object
+
+	// history holds every entry so far. Entries are lexed as a continuation
+	// of it, so that positions stay valid for functions defined earlier.
+	history string
+
+	// the last entry, for :ast and :bytecode
+	program  *ast.Program
+	byteCode *compiler.ByteCode
+}
+
+func New(out io.Writer) *REPL {
+	r := &REPL{out: out}
+	r.reset()
+
+	return r
+}
+
+func (r *REPL) reset() {
+	r.symbols = compiler.NewSymbolTable()
+	r.constants = []object.Object{}
+	r.globals = make([]object.Object, vm.GlobalsSize)
+	r.history, r.program, r.byteCode = "", nil, nil
+}
+
+// Start reads entries from in until it is exhausted or :quit is entered.
+// An entry spans several lines as long as it has unclosed brackets or an
+// unterminated string; an empty line ends it regardless.
+func Start(in io.Reader, out io.Writer) error {
+	r := New(out)
+	scanner := bufio.NewScanner(in)
+
+	var entry []string
+	for {
+		if len(entry) == 0 {
+			fmt.Fprint(out, Prompt)
+		} else {
+			fmt.Fprint(out, ContinuationPrompt)
+		}
+
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		line := scanner.Text()
+
+		if len(entry) == 0 && strings.HasPrefix(strings.TrimSpace(line), ":") {
+			if quit := r.Command(strings.TrimSpace(line)); quit {
+				return nil
+			}
+			continue
+		}
+
+		entry = append(entry, line)
+		source := strings.Join(entry, "\n")
+		if line != "" && Incomplete(source) {
+			continue
+		}
+
+		entry = entry[:0]
+		if strings.TrimSpace(source) != "" {
+			r.Eval(source)
+		}
+	}
+}
+
+// Command runs a meta-command and reports whether the REPL should quit.
+func (r *REPL) Command(line string) bool {
+	command, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch command {
+	case ":quit":
+		return true
+	case ":help":
+		fmt.Fprint(r.out, help)
+	case ":reset":
+		r.reset()
+	case ":ast":
+		if r.program == nil {
+			fmt.Fprintln(r.out, "nothing evaluated yet")
+			break
+		}
+		fmt.Fprintln(r.out, r.program.String())
+	case ":bytecode":
+		if r.byteCode == nil {
+			fmt.Fprintln(r.out, "nothing compiled yet")
+			break
+		}
+		fmt.Fprint(r.out, code.Disassemble(r.byteCode.Instructions, r.byteCode.Positions, r.history))
+	case ":load":
+		if arg == "" {
+			fmt.Fprintln(r.out, "usage: :load <file>")
+			break
+		}
+
+		source, err := os.ReadFile(arg)
+		if err != nil {
+			fmt.Fprintln(r.out, err)
+			break
+		}
+		r.Eval(string(source))
+	default:
+		fmt.Fprintf(r.out, "unknown command %s, :help lists the commands\n", command)
+	}
+
+	return false
+}
+
+// Eval parses, compiles and runs source and prints the value of its last
+// statement, if that is an expression. Errors are printed as well.
+func (r *REPL) Eval(source string) {
+	start := len(r.history)
+	r.history += source + "\n"
+
+	p := parser.New(lexer.NewAt(r.history, start))
+	r.program = p.ParseProgram()
+	if len(p.Diagnostics()) > 0 {
+		fmt.Fprint(r.out, parser.RenderDiagnostics(filename, r.history, p.Diagnostics()))
+		return
+	}
+
+	c := compiler.NewWithState(r.symbols, r.constants)
+	if err := c.Compile(r.program); err != nil {
+		var errs compiler.Errors
+		if errors.As(err, &errs) {
+			fmt.Fprint(r.out, parser.RenderDiagnostics(filename, r.history, errs.Diagnostics()))
+		} else {
+			fmt.Fprintf(r.out, "compile error: %s\n", err)
+		}
+		return
+	}
+	r.byteCode = c.ByteCode()
+	r.constants = r.byteCode.Constants
+
+	machine := vm.NewWithGlobalsStore(r.byteCode, r.globals)
+	machine.SetOutput(r.out)
+	if err := machine.Run(); err != nil {
+		var runtimeErr *vm.RuntimeError
+		if errors.As(err, &runtimeErr) {
+			fmt.Fprint(r.out, runtimeErr.Render(filename, r.history))
+		} else {
+			fmt.Fprintln(r.out, err)
+		}
+		return
+	}
+
+	statements := r.program.Statements
+	if len(statements) == 0 {
+		return
+	}
+	if _, ok := statements[len(statements)-1].(*ast.ExpressionStatement); ok {
+		fmt.Fprintln(r.out, machine.LastPoppedStackElem().Inspect())
+	}
+}
+
+// Incomplete reports whether source ends inside brackets or a string, so
+// that more input is needed to complete it.
+func Incomplete(source string) bool {
+	l := lexer.New(source)
+
+	depth := 0
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case token.LeftBrace, token.LeftParen, token.LeftBracket:
+			depth++
+		case token.RightBrace, token.RightParen, token.RightBracket:
+			depth--
+		case token.Illegal:
+			// an unterminated string runs to the end of the input
+			if strings.HasPrefix(tok.Literal, `"`) && tok.Span.End.Offset == len(source) {
+				return true
+			}
+		}
+	}
+
+	return depth > 0
+}
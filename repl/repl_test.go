@@ -0,0 +1,123 @@
+package repl
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func run(input string) string {
+	var out bytes.Buffer
+	_ = Start(strings.NewReader(input), &out)
+
+	return out.String()
+}
+
+func TestStart(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		expected string
+	}{
+		"expression": {
+			input:    "1 + 2\n",
+			expected: ">> 3\n>> \n",
+		},
+		"persistent_globals": {
+			input:    "let a = 40;\nlet f = fn(x) { x + a };\nf(2)\n",
+			expected: ">> >> >> 42\n>> \n",
+		},
+		"multi_line": {
+			input:    "let add = fn(a, b) {\n  a + b\n};\nadd(1,\n2)\n",
+			expected: ">> .. .. >> .. 3\n>> \n",
+		},
+		"multi_line_string": {
+			input:    "\"a\n\" + \"b\"\n",
+			expected: ">> .. a\nb\n>> \n",
+		},
+		"empty_line_ends_entry": {
+			input:    "if (true) {\n\nlet b = 1;\n",
+			expected: ">> .. error[P004]: expected } to close block opened at 1:11, got EOF instead\n --> <repl>:3:1\n  |\n3 | \n  | ^\n>> >> \n",
+		},
+		"parse_error": {
+			input:    "let = 1;\n",
+			expected: ">> error[P001]: expected next token to be Identifier, got = instead\n --> <repl>:1:5\n  |\n1 | let = 1;\n  |     ^\n>> \n",
+		},
+		"puts": {
+			input:    "puts(\"hello\")\n",
+			expected: ">> hello\nnull\n>> \n",
+		},
+		"compile_error": {
+			input:    "x\n",
+			expected: ">> error[C001]: undefined variable x\n --> <repl>:1:1\n  |\n1 | x\n  | ^\n>> \n",
+		},
+		"runtime_error": {
+			input:    "let d = fn(x) { 1 / x };\nd(0)\n",
+			expected: ">> >> runtime error: division by zero: 1 / 0 (OpDiv at 5)\n  at d (<repl>:1:17)\n      let d = fn(x) { 1 / x };\n  at <main> (<repl>:2:1)\n      d(0)\n>> \n",
+		},
+		"failed_definition": {
+			input:    "let a = 1 / 0;\na\n",
+			expected: ">> runtime error: division by zero: 1 / 0 (OpDiv at 6)\n  at <main> (<repl>:1:9)\n      let a = 1 / 0;\n>> runtime error: global 0 is used before it is set (OpGetGlobal at 0)\n  at <main> (<repl>:2:1)\n      a\n>> \n",
+		},
+		"let_prints_nothing": {
+			input:    "1; let a = 2;\n",
+			expected: ">> >> \n",
+		},
+		"reset": {
+			input:    "let a = 1;\n:reset\na\n",
+			expected: ">> >> >> error[C001]: undefined variable a\n --> <repl>:1:1\n  |\n1 | a\n  | ^\n>> \n",
+		},
+		"ast": {
+			input:    ":ast\nlet a = 1 + 2 * 3;\n:ast\n",
+			expected: ">> nothing evaluated yet\n>> >> let a = (1 + (2 * 3));\n>> \n",
+		},
+		"bytecode": {
+			input:    ":bytecode\n1;\n[1,\n2]\n:bytecode\n",
+			expected: ">> nothing compiled yet\n>> 1\n>> .. [1, 2]\n>>    2 | [1,\n0000 OpConstant 0\n   3 | 2]\n0003 OpConstant 1\n   2 | [1,\n0006 OpArray 2\n0009 OpPop\n>> \n",
+		},
+		"unknown_command": {
+			input:    ":nope\n",
+			expected: ">> unknown command :nope, :help lists the commands\n>> \n",
+		},
+		"quit": {
+			input:    ":quit\n1\n",
+			expected: ">> ",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, run(tc.input))
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "lib.lv")
+	assert.NoError(t, os.WriteFile(file, []byte("let double = fn(x) {\n  x * 2\n};\n"), 0o644))
+
+	assert.Equal(t, ">> >> 42\n>> \n", run(":load "+file+"\ndouble(21)\n"))
+	assert.Contains(t, run(":load "+file+".missing\n"), "no such file or directory")
+	assert.Equal(t, ">> usage: :load <file>\n>> \n", run(":load\n"))
+}
+
+func TestIncomplete(t *testing.T) {
+	tests := map[string]bool{
+		"1 + 2":                  false,
+		"fn(x) {":                true,
+		"fn(x) { x }":            false,
+		"[1, 2,":                 true,
+		"add(1,":                 true,
+		"{\"a\": [1, 2]}":        false,
+		"\"abc":                  true,
+		"\"{\"":                  false,
+		"}":                      false,
+		"if (x) { 1 } else {\n2": true,
+	}
+
+	for input, expected := range tests {
+		assert.Equal(t, expected, Incomplete(input), input)
+	}
+}
@@ -0,0 +1,167 @@
+package script
+
+import (
+	"fmt"
+	"lang_vm/object"
+	"lang_vm/vm"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// ToObject converts a Go value to the object the script sees: nil to null,
+// integers to Integer, bools to Boolean, strings to String, slices and
+// arrays to Array and maps to Hash. Map keys have to convert to Integer,
+// Boolean or String; hash entries are sorted by key, as maps have no order.
+func ToObject(value any) (object.Object, error) {
+	switch v := value.(type) {
+	case nil:
+		return vm.Null, nil
+	case bool:
+		if v {
+			return vm.True, nil
+		}
+		return vm.False, nil
+	case string:
+		return &object.String{Value: v}, nil
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &object.Integer{Value: rv.Int()}, nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("integer %d out of range", rv.Uint())
+		}
+		return &object.Integer{Value: int64(rv.Uint())}, nil
+
+	case reflect.Bool:
+		return ToObject(rv.Bool())
+
+	case reflect.String:
+		return ToObject(rv.String())
+
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return vm.Null, nil
+		}
+
+		elements := make([]object.Object, rv.Len())
+		for i := range elements {
+			element, err := ToObject(rv.Index(i).Interface())
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %w", i, err)
+			}
+			elements[i] = element
+		}
+		return &object.Array{Elements: elements}, nil
+
+	case reflect.Map:
+		if rv.IsNil() {
+			return vm.Null, nil
+		}
+		return mapToHash(rv)
+
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return vm.Null, nil
+		}
+		return ToObject(rv.Elem().Interface())
+	}
+
+	return nil, fmt.Errorf("unsupported type %T", value)
+}
+
+func mapToHash(rv reflect.Value) (object.Object, error) {
+	type entry struct {
+		key   object.Hashable
+		value object.Object
+	}
+
+	entries := make([]entry, 0, rv.Len())
+	for iter := rv.MapRange(); iter.Next(); {
+		key, err := ToObject(iter.Key().Interface())
+		if err != nil {
+			return nil, fmt.Errorf("key %v: %w", iter.Key(), err)
+		}
+
+		hashable, ok := key.(object.Hashable)
+		if !ok {
+			return nil, fmt.Errorf("key %v: unusable as hash key: %s", iter.Key(), key.Type())
+		}
+
+		value, err := ToObject(iter.Value().Interface())
+		if err != nil {
+			return nil, fmt.Errorf("key %v: %w", iter.Key(), err)
+		}
+
+		entries = append(entries, entry{key: hashable, value: value})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		ki, kj := entries[i].key.(object.Object), entries[j].key.(object.Object)
+		if ki.Type() != kj.Type() {
+			return ki.Type() < kj.Type()
+		}
+		if a, ok := ki.(*object.Integer); ok {
+			return a.Value < kj.(*object.Integer).Value
+		}
+		return ki.Inspect() < kj.Inspect()
+	})
+
+	hash := object.NewHash()
+	for _, e := range entries {
+		hash.Set(e.key, e.value)
+	}
+
+	return hash, nil
+}
+
+// FromObject converts an object to a Go value: null to nil, Integer to
+// int64, Boolean to bool, String to string, Array to []any and Hash to
+// map[any]any, whose keys are int64, bool or string. Functions have no Go
+// counterpart.
+func FromObject(obj object.Object) (any, error) {
+	switch obj := obj.(type) {
+	case nil, *object.Null:
+		return nil, nil
+	case *object.Integer:
+		return obj.Value, nil
+	case *object.Boolean:
+		return obj.Value, nil
+	case *object.String:
+		return obj.Value, nil
+
+	case *object.Array:
+		elements := make([]any, len(obj.Elements))
+		for i, e := range obj.Elements {
+			element, err := FromObject(e)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %w", i, err)
+			}
+			elements[i] = element
+		}
+		return elements, nil
+
+	case *object.Hash:
+		m := make(map[any]any, len(obj.Pairs))
+		for _, hashKey := range obj.Keys {
+			pair := obj.Pairs[hashKey]
+
+			key, err := FromObject(pair.Key)
+			if err != nil {
+				return nil, err
+			}
+			value, err := FromObject(pair.Value)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", pair.Key.Inspect(), err)
+			}
+			m[key] = value
+		}
+		return m, nil
+	}
+
+	return nil, fmt.Errorf("cannot convert %s to a Go value", obj.Type())
+}
@@ -0,0 +1,154 @@
+// Package script compiles and runs scripts for applications that embed the
+// language, e.g. to evaluate rules.
+//
+//	program, err := script.Compile(`if (age >= 18) { "adult" } else { "minor" }`)
+//	...
+//	result, err := program.Run(ctx, map[string]any{"age": 21})
+//
+// Names a script uses without defining them are variables the host passes
+// to Run. A compiled Program can be run any number of times, also
+// concurrently, every run has its own VM and globals.
+package script
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"lang_vm/ast"
+	"lang_vm/compiler"
+	"lang_vm/lexer"
+	"lang_vm/object"
+	"lang_vm/parser"
+	"lang_vm/vm"
+	"os"
+	"strings"
+)
+
+// Program is a compiled script.
+type Program struct {
+	prepared *vm.Prepared
+
+	// numGlobals is the number of global slots a run needs.
+	numGlobals int
+
+	// variables are the globals the host has to set, see Variables.
+	variables []compiler.Symbol
+
+	// hasResult is set if the script ends in an expression, whose value
+	// Run returns.
+	hasResult bool
+
+	limits vm.Limits
+
+	// out is where puts prints to.
+	out io.Writer
+}
+
+// SyntaxError is returned by Compile for source that doesn't parse.
+type SyntaxError struct {
+	Diagnostics []parser.Diagnostic
+}
+
+func (e *SyntaxError) Error() string {
+	messages := make([]string, 0, len(e.Diagnostics))
+	for _, d := range e.Diagnostics {
+		messages = append(messages, d.String())
+	}
+
+	return "syntax error: " + strings.Join(messages, "; ")
+}
+
+// Compile parses and compiles src.
+func Compile(src string) (*Program, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Diagnostics()) > 0 {
+		return nil, &SyntaxError{Diagnostics: p.Diagnostics()}
+	}
+
+	symbols := compiler.NewHostSymbolTable()
+	c := compiler.NewWithState(symbols, []object.Object{})
+	if err := c.Compile(program); err != nil {
+		return nil, fmt.Errorf("compile error: %w", err)
+	}
+
+	prepared, err := vm.Prepare(c.ByteCode())
+	if err != nil {
+		return nil, err
+	}
+
+	prog := &Program{
+		prepared:   prepared,
+		numGlobals: symbols.NumDefinitions(),
+		variables:  symbols.HostSymbols,
+		out:        os.Stdout,
+	}
+	if n := len(program.Statements); n > 0 {
+		_, prog.hasResult = program.Statements[n-1].(*ast.ExpressionStatement)
+	}
+
+	return prog, nil
+}
+
+// Variables returns the names of the variables Run expects, in the order
+// the script first uses them.
+func (p *Program) Variables() []string {
+	names := make([]string, 0, len(p.variables))
+	for _, symbol := range p.variables {
+		names = append(names, symbol.Name)
+	}
+
+	return names
+}
+
+// WithLimits returns a copy of the program whose runs are bounded by limits.
+func (p *Program) WithLimits(limits vm.Limits) *Program {
+	limited := *p
+	limited.limits = limits
+
+	return &limited
+}
+
+// WithOutput returns a copy of the program whose runs print to out instead
+// of os.Stdout.
+func (p *Program) WithOutput(out io.Writer) *Program {
+	redirected := *p
+	redirected.out = out
+
+	return &redirected
+}
+
+// Run executes the program with the given variables, converted by ToObject,
+// and returns the value of its last expression converted by FromObject, or
+// nil if the script doesn't end in an expression. Variables the script
+// doesn't use are ignored, a missing one is an error. Errors raised by the
+// script are *vm.RuntimeError, including vm.ErrCancelled and
+// vm.ErrDeadline once ctx is done.
+func (p *Program) Run(ctx context.Context, vars map[string]any) (any, error) {
+	globals := make([]object.Object, p.numGlobals)
+	for _, symbol := range p.variables {
+		value, ok := vars[symbol.Name]
+		if !ok {
+			return nil, fmt.Errorf("missing variable %s", symbol.Name)
+		}
+
+		obj, err := ToObject(value)
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %w", symbol.Name, err)
+		}
+		globals[symbol.Index] = obj
+	}
+
+	machine := vm.NewVerified(p.prepared, globals)
+	machine.SetLimits(p.limits)
+	machine.SetOutput(p.out)
+	if err := machine.RunContext(ctx); err != nil {
+		return nil, err
+	}
+
+	if !p.hasResult {
+		return nil, nil
+	}
+
+	return FromObject(machine.LastPoppedStackElem())
+}
@@ -0,0 +1,195 @@
+package script
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"lang_vm/object"
+	"lang_vm/vm"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	tests := map[string]struct {
+		src      string
+		vars     map[string]any
+		expected any
+	}{
+		"integer":      {src: "1 + 2", expected: int64(3)},
+		"variable":     {src: "age >= 18", vars: map[string]any{"age": 21}, expected: true},
+		"variables":    {src: `if (vip) { name + "!" } else { name }`, vars: map[string]any{"vip": true, "name": "ann"}, expected: "ann!"},
+		"unused":       {src: "1", vars: map[string]any{"other": 1}, expected: int64(1)},
+		"in_function":  {src: "let f = fn() { limit * 2 }; f()", vars: map[string]any{"limit": uint8(5)}, expected: int64(10)},
+		"slice":        {src: "len(xs) + xs[-1]", vars: map[string]any{"xs": []int{1, 2, 3}}, expected: int64(6)},
+		"map":          {src: `user["roles"][0]`, vars: map[string]any{"user": map[string]any{"roles": []string{"admin"}}}, expected: "admin"},
+		"nil":          {src: "x", vars: map[string]any{"x": nil}, expected: nil},
+		"pointer":      {src: "x", vars: map[string]any{"x": new(int)}, expected: int64(0)},
+		"redefined":    {src: "let x = x + 1; x", vars: map[string]any{"x": 1}, expected: int64(2)},
+		"array_result": {src: `[1, "a", true, [2]]`, expected: []any{int64(1), "a", true, []any{int64(2)}}},
+		"hash_result":  {src: `{"a": 1, 2: false}`, expected: map[any]any{"a": int64(1), int64(2): false}},
+		"null_result":  {src: "if (false) { 1 }", expected: nil},
+		"no_result":    {src: "1; let a = 1;", expected: nil},
+		"empty":        {src: "", expected: nil},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			program, err := Compile(tc.src)
+			assert.NoError(t, err)
+
+			got, err := program.Run(context.Background(), tc.vars)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	tests := map[string]struct {
+		src  string
+		vars map[string]any
+		err  string
+	}{
+		"missing_variable":  {src: "a + b", vars: map[string]any{"a": 1}, err: "missing variable b"},
+		"unsupported_value": {src: "a", vars: map[string]any{"a": 1.5}, err: "variable a: unsupported type float64"},
+		"unsupported_nested": {
+			src:  "a",
+			vars: map[string]any{"a": map[string]any{"b": []any{struct{}{}}}},
+			err:  "variable a: key b: element 0: unsupported type struct {}",
+		},
+		"bad_key":         {src: "a", vars: map[string]any{"a": map[any]int{[1]int{}: 1}}, err: "variable a: key [0]: unusable as hash key: Array"},
+		"integer_range":   {src: "a", vars: map[string]any{"a": uint64(1 << 63)}, err: "variable a: integer 9223372036854775808 out of range"},
+		"runtime_error":   {src: "1 / zero", vars: map[string]any{"zero": 0}, err: "division by zero: 1 / 0"},
+		"function_result": {src: "fn() { 1 }", err: "cannot convert Closure to a Go value"},
+		"builtin_wins":    {src: "len", vars: map[string]any{"len": 1}, err: "cannot convert Builtin to a Go value"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			program, err := Compile(tc.src)
+			assert.NoError(t, err)
+
+			_, err = program.Run(context.Background(), tc.vars)
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+
+	program, err := Compile("1 / 0")
+	assert.NoError(t, err)
+	_, err = program.Run(context.Background(), nil)
+
+	var runtimeErr *vm.RuntimeError
+	assert.True(t, errors.As(err, &runtimeErr))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = program.Run(ctx, nil)
+	assert.ErrorIs(t, err, vm.ErrCancelled)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestRunTimeout(t *testing.T) {
+	// exponential, runs for far longer than the timeout
+	program, err := Compile("let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(n)")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = program.Run(ctx, map[string]any{"n": 60})
+	assert.ErrorIs(t, err, vm.ErrDeadline)
+}
+
+func TestWithLimits(t *testing.T) {
+	program, err := Compile("let f = fn(n) { if (n == 0) { 0 } else { n + f(n - 1) } }; f(depth)")
+	assert.NoError(t, err)
+
+	limited := program.WithLimits(vm.Limits{MaxCallDepth: 10})
+
+	got, err := program.Run(context.Background(), map[string]any{"depth": 20})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(210), got)
+
+	_, err = limited.Run(context.Background(), map[string]any{"depth": 20})
+	assert.ErrorIs(t, err, vm.ErrCallDepthLimit)
+}
+
+func TestWithOutput(t *testing.T) {
+	program, err := Compile(`puts("hello", n)`)
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	_, err = program.WithOutput(&out).Run(context.Background(), map[string]any{"n": 1})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n1\n", out.String())
+}
+
+func TestCompileErrors(t *testing.T) {
+	_, err := Compile("let = 1;")
+	assert.EqualError(t, err, "syntax error: 1:5: error[P001]: expected next token to be Identifier, got = instead")
+
+	var syntaxErr *SyntaxError
+	assert.True(t, errors.As(err, &syntaxErr))
+	assert.Len(t, syntaxErr.Diagnostics, 1)
+
+	_, err = Compile("return 1;")
+	assert.EqualError(t, err, "compile error: return statement outside of function")
+}
+
+func TestVariables(t *testing.T) {
+	program, err := Compile("let a = b; let f = fn(x) { x + c + a }; f(b) + len(d)")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c", "d"}, program.Variables())
+}
+
+func TestRunConcurrently(t *testing.T) {
+	program, err := Compile("let total = fn(xs) { if (len(xs) == 0) { 0 } else { xs[0] + total(rest(xs)) } }; total(xs) * factor")
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	results := make([]any, 50)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var err error
+			results[i], err = program.Run(context.Background(), map[string]any{"xs": []int{1, 2, 3}, "factor": i})
+			if err != nil {
+				results[i] = err
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, result := range results {
+		assert.Equal(t, int64(6*i), result, fmt.Sprintf("run %d", i))
+	}
+}
+
+func TestConvert(t *testing.T) {
+	obj, err := ToObject(map[string][]bool{"b": {true}, "a": nil})
+	assert.NoError(t, err)
+	assert.Equal(t, `{a: null, b: [true]}`, obj.Inspect())
+
+	obj, err = ToObject(map[int]string{10: "x", 2: "y", -1: "z"})
+	assert.NoError(t, err)
+	assert.Equal(t, `{-1: z, 2: y, 10: x}`, obj.Inspect())
+
+	obj, err = ToObject(true)
+	assert.NoError(t, err)
+	assert.Same(t, vm.True, obj)
+
+	type flag bool
+	obj, err = ToObject(flag(false))
+	assert.NoError(t, err)
+	assert.Same(t, vm.False, obj)
+
+	value, err := FromObject(&object.Array{Elements: []object.Object{vm.Null, &object.String{Value: "s"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, []any{nil, "s"}, value)
+}
@@ -1,10 +1,68 @@
 package token
 
+import (
+	"fmt"
+	"strings"
+)
+
 type TokenType string
 
 type Token struct {
 	Type    TokenType
 	Literal string
+	Span    Span
+}
+
+// Pos is a location in the source. Line and Column are 1-based, Column
+// counts bytes; Offset is the 0-based byte offset into the input.
+type Pos struct {
+	Line   int
+	Column int
+	Offset int
+}
+
+// IsValid reports whether p refers to an actual source location; the zero
+// Pos does not.
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Pos) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Span is the half-open source range [Start, End).
+type Span struct {
+	Start Pos
+	End   Pos
+}
+
+func (s Span) String() string {
+	return fmt.Sprintf("%s-%s", s.Start, s.End)
+}
+
+// SourceLine returns the line of source that pos is on, without its line
+// terminator.
+func SourceLine(source string, pos Pos) (string, bool) {
+	if !pos.IsValid() || pos.Offset > len(source) {
+		return "", false
+	}
+
+	start := pos.Offset - (pos.Column - 1)
+	if start < 0 {
+		return "", false
+	}
+
+	end := strings.IndexByte(source[start:], '\n')
+	if end < 0 {
+		end = len(source) - start
+	}
+
+	return strings.TrimRight(source[start:start+end], "\r"), true
 }
 
 const (
@@ -26,8 +84,10 @@ const (
 	Equal    = "=="
 	NotEqual = "!="
 
-	LessThan    = "<"
-	GreaterThan = ">"
+	LessThan           = "<"
+	GreaterThan        = ">"
+	LessThanOrEqual    = "<="
+	GreaterThanOrEqual = ">="
 
 	// Delimiters
 	Comma     = ","
@@ -0,0 +1,60 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lang_vm/code"
+	"lang_vm/object"
+)
+
+// Errors for runs stopped by their context. RunContext returns them wrapped
+// in a *RuntimeError together with the context's error, so errors.Is also
+// matches context.Canceled and context.DeadlineExceeded.
+var (
+	ErrCancelled = errors.New("run cancelled")
+	ErrDeadline  = errors.New("run deadline exceeded")
+)
+
+// checkInterval is the number of instructions between checks of the
+// context in code without calls or backward jumps.
+const checkInterval = 1024
+
+// isCheckpoint reports whether the instruction at ip is a call or a
+// backward jump, before which the context is checked regardless of
+// checkInterval.
+func isCheckpoint(ins code.Instructions, ip int) bool {
+	switch code.OpCode(ins[ip]) {
+	case code.OpCall:
+		return true
+	case code.OpJump, code.OpJumpNotTruthy:
+		return int(code.ReadUint16(ins[ip+1:])) <= ip
+	default:
+		return false
+	}
+}
+
+func checkContext(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+	default:
+		return nil
+	}
+
+	cause := context.Cause(ctx)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrDeadline, cause)
+	}
+
+	return fmt.Errorf("%w: %w", ErrCancelled, cause)
+}
+
+// Stack returns the values on the operand stack, bottom first, including
+// the locals of active calls. It is meant for inspecting a VM stopped by an
+// error.
+func (vm *VM) Stack() []object.Object {
+	stack := make([]object.Object, vm.sp)
+	copy(stack, vm.stack[:vm.sp])
+
+	return stack
+}
@@ -0,0 +1,113 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"lang_vm/code"
+	"lang_vm/object"
+	"testing"
+	"time"
+)
+
+// cancelRun is called by the cancelRun builtin, to cancel a run at a known
+// point.
+var cancelRun context.CancelFunc
+
+func init() {
+	err := object.RegisterBuiltin("cancelRun", func(args ...object.Object) object.Object {
+		cancelRun()
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestRunContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelRun = cancel
+
+	vm := New(compileSource(t, "let f = fn(x) { x * 2 }; cancelRun(); f(21)"))
+	err := vm.RunContext(ctx)
+
+	assert.EqualError(t, err, "run cancelled: context canceled")
+	assert.ErrorIs(t, err, ErrCancelled)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// stopped before calling f, with f and its argument on the stack
+	var runtimeErr *RuntimeError
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.Equal(t, code.OpCall, runtimeErr.Op)
+	assert.Equal(t, "<main> (1:39)", runtimeErr.Trace[0].String())
+
+	stack := vm.Stack()
+	assert.Len(t, stack, 2)
+	assert.IsType(t, &object.Closure{}, stack[0])
+	assert.Equal(t, &object.Integer{Value: 21}, stack[1])
+
+	// the run continues where it stopped
+	assert.NoError(t, vm.Run())
+	assert.Equal(t, &object.Integer{Value: 42}, vm.LastPoppedStackElem())
+}
+
+func TestRunContextBeforeStart(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errors.New("client went away"))
+
+	vm := New(compileSource(t, "1 + 2"))
+	err := vm.RunContext(ctx)
+
+	assert.EqualError(t, err, "run cancelled: client went away")
+
+	var runtimeErr *RuntimeError
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.Equal(t, 0, runtimeErr.IP)
+	assert.Empty(t, vm.Stack())
+}
+
+func TestRunContextDeadline(t *testing.T) {
+	tests := map[string]string{
+		"jump":             "loop: OpJump loop",
+		"conditional_jump": "loop: OpNull\nOpPop\nOpFalse\nOpJumpNotTruthy loop",
+	}
+
+	for name, listing := range tests {
+		t.Run(name, func(t *testing.T) {
+			byteCode := assemble(t, listing)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			err := New(byteCode).RunContext(ctx)
+
+			assert.ErrorIs(t, err, ErrDeadline)
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			assert.EqualError(t, err, "run deadline exceeded: context deadline exceeded")
+			assert.Less(t, time.Since(start), time.Second)
+		})
+	}
+}
+
+func TestIsCheckpoint(t *testing.T) {
+	ins := code.NewBuilder().
+		Add(code.OpNull).
+		Add(code.OpJumpNotTruthy, 7).
+		Add(code.OpCall, 0).
+		Add(code.OpJump, 0).
+		Build()
+
+	var checkpoints []int
+	for ip := 0; ip < len(ins); {
+		if isCheckpoint(ins, ip) {
+			checkpoints = append(checkpoints, ip)
+		}
+
+		def, _ := code.Lookup(ins[ip])
+		_, read := code.ReadOperands(def, ins[ip+1:])
+		ip += 1 + read
+	}
+
+	assert.Equal(t, []int{4, 6}, checkpoints)
+}
@@ -0,0 +1,135 @@
+package vm
+
+import (
+	"fmt"
+	"lang_vm/code"
+	"lang_vm/token"
+	"strings"
+)
+
+// maxTraceEntries bounds the number of calls StackTrace and Render print,
+// the calls beyond are summed up in a single line.
+const maxTraceEntries = 50
+
+// StackFrame is one call in the script stack trace of a RuntimeError.
+type StackFrame struct {
+	Function string
+	IP       int
+
+	// Span is the source of the instruction at IP. It is invalid if the
+	// byte code carries no positions.
+	Span token.Span
+}
+
+func (f StackFrame) String() string {
+	return fmt.Sprintf("%s (%s)", f.Function, f.Span.Start)
+}
+
+// RuntimeError is returned by Run when the script fails. Op and IP locate
+// the failing instruction in the innermost function, Trace lists the
+// active calls innermost first.
+type RuntimeError struct {
+	Err   error
+	Op    code.OpCode
+	IP    int
+	Trace []StackFrame
+}
+
+func (e *RuntimeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// StackTrace returns the trace one call per line, e.g. "at add (2:3)".
+// Consecutive calls from the same instruction, as left by recursion, are
+// printed once, followed by the number of repetitions.
+func (e *RuntimeError) StackTrace() string {
+	var out strings.Builder
+	e.writeTrace(&out, func(f StackFrame) {
+		fmt.Fprintf(&out, "  at %s\n", f)
+	})
+
+	return out.String()
+}
+
+// Render formats the error with its stack trace, showing the source line
+// of every call. source is the script the byte code was compiled from.
+func (e *RuntimeError) Render(filename, source string) string {
+	var out strings.Builder
+
+	fmt.Fprintf(&out, "runtime error: %s (%s at %d)\n", e.Err, e.Op, e.IP)
+	e.writeTrace(&out, func(f StackFrame) {
+		location := f.Span.Start.String()
+		if filename != "" {
+			location = filename + ":" + location
+		}
+		fmt.Fprintf(&out, "  at %s (%s)\n", f.Function, location)
+
+		if line, ok := token.SourceLine(source, f.Span.Start); ok {
+			fmt.Fprintf(&out, "      %s\n", strings.TrimSpace(line))
+		}
+	})
+
+	return out.String()
+}
+
+// writeTrace calls frame for every entry of the trace and writes the lines
+// summing up repeated and omitted calls to out.
+func (e *RuntimeError) writeTrace(out *strings.Builder, frame func(StackFrame)) {
+	entries := 0
+	for i := 0; i < len(e.Trace); {
+		if entries == maxTraceEntries {
+			fmt.Fprintf(out, "  ... %d more calls\n", len(e.Trace)-i)
+			return
+		}
+
+		f := e.Trace[i]
+		repeats := 1
+		for i+repeats < len(e.Trace) && e.Trace[i+repeats] == f {
+			repeats++
+		}
+
+		frame(f)
+		if repeats > 1 {
+			fmt.Fprintf(out, "  ... %d more calls of %s\n", repeats-1, f.Function)
+		}
+
+		entries++
+		i += repeats
+	}
+}
+
+// newRuntimeError wraps err, raised by op at ip, with the current stack
+// trace.
+func (vm *VM) newRuntimeError(err error, op code.OpCode, ip int) *RuntimeError {
+	trace := make([]StackFrame, 0, vm.framesIndex)
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+
+		frameIP := ip
+		if i < vm.framesIndex-1 {
+			// callers have already advanced past their OpCall and its one
+			// byte operand
+			frameIP = frame.ip - 2
+		}
+
+		span, _ := frame.cl.Fn.Positions.Lookup(frameIP)
+		trace = append(trace, StackFrame{Function: frameName(frame, i), IP: frameIP, Span: span})
+	}
+
+	return &RuntimeError{Err: err, Op: op, IP: ip, Trace: trace}
+}
+
+func frameName(f *Frame, index int) string {
+	switch {
+	case index == 0:
+		return "<main>"
+	case f.cl.Fn.Name == "":
+		return "<anonymous>"
+	default:
+		return f.cl.Fn.Name
+	}
+}
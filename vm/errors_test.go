@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"lang_vm/code"
+	"lang_vm/compiler"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeError(t *testing.T) {
+	input := "let div = fn(a, b) {\n  a / b\n};\nlet half = fn(x) { div(x, 2) + div(x, 0) };\nhalf(10)"
+
+	vm := New(compileSource(t, input))
+	err := vm.Run()
+
+	var runtimeErr *RuntimeError
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.EqualError(t, err, "division by zero: 10 / 0")
+	assert.Equal(t, code.OpDiv, runtimeErr.Op)
+	assert.Equal(t, 4, runtimeErr.IP)
+
+	var trace []string
+	var ips []int
+	for _, f := range runtimeErr.Trace {
+		trace = append(trace, f.String())
+		ips = append(ips, f.IP)
+	}
+	assert.Equal(t, []string{"div (2:3)", "half (4:32)", "<main> (5:1)"}, trace)
+	// the callers stopped at their OpCall
+	assert.Equal(t, []int{4, 18, 20}, ips)
+
+	assert.Equal(t, "  at div (2:3)\n  at half (4:32)\n  at <main> (5:1)\n", runtimeErr.StackTrace())
+	assert.Equal(t, `runtime error: division by zero: 10 / 0 (OpDiv at 4)
+  at div (script.lv:2:3)
+      a / b
+  at half (script.lv:4:32)
+      let half = fn(x) { div(x, 2) + div(x, 0) };
+  at <main> (script.lv:5:1)
+      half(10)
+`, runtimeErr.Render("script.lv", input))
+}
+
+func TestRuntimeErrorAnonymousFunction(t *testing.T) {
+	vm := New(compileSource(t, "fn() { -true }()"))
+	err := vm.Run()
+
+	var runtimeErr *RuntimeError
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.Equal(t, code.OpMinus, runtimeErr.Op)
+	assert.Equal(t, "  at <anonymous> (1:8)\n  at <main> (1:1)\n", runtimeErr.StackTrace())
+}
+
+func TestRuntimeErrorFromBuiltin(t *testing.T) {
+	vm := New(compileSource(t, "let xs = 1;\nlen(xs)"))
+	err := vm.Run()
+
+	var runtimeErr *RuntimeError
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.EqualError(t, err, "argument to len not supported: Integer")
+	assert.Equal(t, code.OpCall, runtimeErr.Op)
+	assert.Equal(t, "  at <main> (2:1)\n", runtimeErr.StackTrace())
+}
+
+func TestRuntimeErrorWithoutPositions(t *testing.T) {
+	vm := New(&compiler.ByteCode{
+		Instructions: code.NewBuilder().Add(code.OpTrue).Add(code.OpMinus).Build(),
+	})
+	err := vm.Run()
+
+	var runtimeErr *RuntimeError
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.Equal(t, 1, runtimeErr.IP)
+	assert.Equal(t, "runtime error: unsupported type for negation: Boolean (OpMinus at 1)\n  at <main> (script.lv:-)\n",
+		runtimeErr.Render("script.lv", ""))
+}
+
+func TestRuntimeErrorRecursion(t *testing.T) {
+	input := "let f = fn(n) {\n  if (n == 0) { 1 / n } else { f(n - 1) }\n};\nf(100)"
+
+	vm := New(compileSource(t, input))
+	err := vm.Run()
+
+	var runtimeErr *RuntimeError
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.Len(t, runtimeErr.Trace, 102)
+	assert.Equal(t, "  at f (2:17)\n  at f (2:32)\n  ... 99 more calls of f\n  at <main> (4:1)\n", runtimeErr.StackTrace())
+	assert.Equal(t, `runtime error: division by zero: 1 / 0 (OpDiv at 14)
+  at f (script.lv:2:17)
+      if (n == 0) { 1 / n } else { f(n - 1) }
+  at f (script.lv:2:32)
+      if (n == 0) { 1 / n } else { f(n - 1) }
+  ... 99 more calls of f
+  at <main> (script.lv:4:1)
+      f(100)
+`, runtimeErr.Render("script.lv", input))
+}
+
+func TestRuntimeErrorTraceLimit(t *testing.T) {
+	// f and g call each other, so no two consecutive frames are the same
+	input := "let f = fn(n, g) { if (n == 0) { -true } else { g(n - 1, f) } };\nlet g = fn(n, f) { f(n, g) };\nf(100, g)"
+
+	vm := New(compileSource(t, input))
+	err := vm.Run()
+
+	var runtimeErr *RuntimeError
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.Len(t, runtimeErr.Trace, 202)
+
+	lines := strings.Split(strings.TrimSuffix(runtimeErr.StackTrace(), "\n"), "\n")
+	assert.Len(t, lines, maxTraceEntries+1)
+	assert.Equal(t, "  ... 152 more calls", lines[maxTraceEntries])
+}
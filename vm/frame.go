@@ -0,0 +1,24 @@
+package vm
+
+import (
+	"lang_vm/code"
+	"lang_vm/object"
+)
+
+// Frame is the execution state of a single function call.
+type Frame struct {
+	cl *object.Closure
+	ip int
+
+	// basePointer is the stack pointer before the call; the function's
+	// locals live in the slots starting at it.
+	basePointer int
+}
+
+func NewFrame(cl *object.Closure, basePointer int) *Frame {
+	return &Frame{cl: cl, ip: 0, basePointer: basePointer}
+}
+
+func (f *Frame) Instructions() code.Instructions {
+	return f.cl.Fn.Instructions
+}
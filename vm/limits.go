@@ -0,0 +1,97 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"lang_vm/object"
+)
+
+// Errors for runs exceeding their Limits. Run returns them wrapped in a
+// *RuntimeError, test for them with errors.Is.
+var (
+	ErrInstructionLimit = errors.New("instruction limit exceeded")
+	ErrCallDepthLimit   = errors.New("call depth limit exceeded")
+	ErrStackLimit       = errors.New("stack limit exceeded")
+	ErrHeapLimit        = errors.New("heap limit exceeded")
+)
+
+// Limits bound the resources a run may use, so that scripts from untrusted
+// sources can't run forever or exhaust memory. Zero fields leave the
+// resource bounded by the VM's capacity only.
+type Limits struct {
+	// MaxInstructions bounds the number of instructions executed.
+	MaxInstructions int64
+
+	// MaxCallDepth bounds the number of nested calls, at most MaxFrames-1.
+	MaxCallDepth int
+
+	// MaxStackSize bounds the number of operand stack slots, including the
+	// locals of active calls, at most StackSize.
+	MaxStackSize int
+
+	// MaxHeapBytes bounds the approximate number of bytes of the values
+	// created while running. It counts every allocation, not the memory
+	// in use at any time, as the VM can't tell when values become garbage.
+	MaxHeapBytes int64
+}
+
+// SetLimits applies limits to the following runs. Limits beyond the VM's
+// capacity are lowered to it.
+func (vm *VM) SetLimits(limits Limits) {
+	if limits.MaxCallDepth <= 0 || limits.MaxCallDepth > MaxFrames-1 {
+		limits.MaxCallDepth = MaxFrames - 1
+	}
+	if limits.MaxStackSize <= 0 || limits.MaxStackSize > StackSize {
+		limits.MaxStackSize = StackSize
+	}
+
+	vm.limits = limits
+}
+
+// countInstruction is called for every instruction executed.
+func (vm *VM) countInstruction() error {
+	vm.instructions++
+	if max := vm.limits.MaxInstructions; max > 0 && vm.instructions > max {
+		return fmt.Errorf("%w: more than %d instructions", ErrInstructionLimit, max)
+	}
+
+	return nil
+}
+
+// allocate charges the size of a value created while running to the heap
+// budget.
+func (vm *VM) allocate(obj object.Object) error {
+	if vm.limits.MaxHeapBytes <= 0 {
+		return nil
+	}
+
+	vm.heapBytes += sizeOf(obj)
+	if vm.heapBytes > vm.limits.MaxHeapBytes {
+		return fmt.Errorf("%w: more than %d bytes allocated", ErrHeapLimit, vm.limits.MaxHeapBytes)
+	}
+
+	return nil
+}
+
+// sizeOf estimates the bytes allocated for obj itself, not counting the
+// values it refers to, which are charged when they are created.
+func sizeOf(obj object.Object) int64 {
+	const word = 8
+
+	switch obj := obj.(type) {
+	case *object.Boolean, *object.Null:
+		// shared, never allocated
+		return 0
+	case *object.String:
+		return 2*word + int64(len(obj.Value))
+	case *object.Array:
+		return 3*word + 2*word*int64(len(obj.Elements))
+	case *object.Hash:
+		// a map entry holds the key and the pair, Keys the key once more
+		return 6*word + 9*word*int64(len(obj.Keys))
+	case *object.Closure:
+		return 4*word + 2*word*int64(len(obj.Free))
+	default:
+		return 2 * word
+	}
+}
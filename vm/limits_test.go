@@ -0,0 +1,122 @@
+package vm
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"lang_vm/compiler"
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	a40 := `"` + strings.Repeat("a", 40) + `"`
+	recurse := "let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; "
+
+	tests := map[string]struct {
+		byteCode *compiler.ByteCode
+		limits   Limits
+		target   error
+		err      string
+	}{
+		"instructions_within": {
+			byteCode: compileSource(t, "1 + 2"),
+			limits:   Limits{MaxInstructions: 4},
+		},
+		"instructions": {
+			byteCode: compileSource(t, "1 + 2"),
+			limits:   Limits{MaxInstructions: 3},
+			target:   ErrInstructionLimit,
+			err:      "instruction limit exceeded: more than 3 instructions",
+		},
+		"instructions_endless_loop": {
+			byteCode: assemble(t, "loop: OpJump loop"),
+			limits:   Limits{MaxInstructions: 1000},
+			target:   ErrInstructionLimit,
+			err:      "instruction limit exceeded: more than 1000 instructions",
+		},
+		"call_depth_within": {
+			byteCode: compileSource(t, recurse+"f(9)"),
+			limits:   Limits{MaxCallDepth: 10},
+		},
+		"call_depth": {
+			byteCode: compileSource(t, recurse+"f(10)"),
+			limits:   Limits{MaxCallDepth: 10},
+			target:   ErrCallDepthLimit,
+			err:      "call depth limit exceeded: more than 10 nested calls",
+		},
+		"call_depth_capacity": {
+			byteCode: compileSource(t, "let f = fn() { f() }; f()"),
+			limits:   Limits{MaxCallDepth: 5000},
+			target:   ErrCallDepthLimit,
+			err:      "call depth limit exceeded: more than 1023 nested calls",
+		},
+		"stack_within": {
+			byteCode: compileSource(t, "[1, 2, 3, 4]"),
+			limits:   Limits{MaxStackSize: 4},
+		},
+		"stack": {
+			byteCode: compileSource(t, "[1, 2, 3, 4, 5]"),
+			limits:   Limits{MaxStackSize: 4},
+			target:   ErrStackLimit,
+			err:      "stack limit exceeded: more than 4 stack slots",
+		},
+		"stack_locals": {
+			byteCode: compileSource(t, "let f = fn(a) { let b = 1; let c = 2; a }; f(1)"),
+			limits:   Limits{MaxStackSize: 3},
+			target:   ErrStackLimit,
+			err:      "stack limit exceeded: more than 3 stack slots",
+		},
+		"stack_capacity": {
+			// fills the stack while every frame stays small
+			byteCode: compileSource(t, "let f = fn(n) { 1 + f(n) }; f(0)"),
+			target:   ErrStackLimit,
+			err:      "stack limit exceeded: more than 2048 stack slots",
+		},
+		"heap_within": {
+			byteCode: compileSource(t, "let x = "+a40+"; x + x + x"),
+			limits:   Limits{MaxHeapBytes: 232},
+		},
+		"heap": {
+			byteCode: compileSource(t, "let x = "+a40+"; x + x + x"),
+			limits:   Limits{MaxHeapBytes: 231},
+			target:   ErrHeapLimit,
+			err:      "heap limit exceeded: more than 231 bytes allocated",
+		},
+		"heap_arrays": {
+			byteCode: compileSource(t, "let a = [1, 2, 3]; push(a, 4)"),
+			limits:   Limits{MaxHeapBytes: 100},
+			target:   ErrHeapLimit,
+			err:      "heap limit exceeded: more than 100 bytes allocated",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			vm := New(tc.byteCode)
+			vm.SetLimits(tc.limits)
+
+			err := vm.Run()
+			if tc.target == nil {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.EqualError(t, err, tc.err)
+			assert.True(t, errors.Is(err, tc.target))
+
+			var runtimeErr *RuntimeError
+			assert.True(t, errors.As(err, &runtimeErr))
+		})
+	}
+}
+
+func TestSizeOf(t *testing.T) {
+	bc := compileSource(t, `[1, "ab", {"k": [true]}, fn(x) { x }]`)
+
+	vm := New(bc)
+	vm.SetLimits(Limits{MaxHeapBytes: 1 << 20})
+	assert.NoError(t, vm.Run())
+
+	// the array, the inner array and hash, and the closure
+	assert.Equal(t, int64((3+8)+(3+2)+(6+9)+4)*8, vm.heapBytes)
+}
@@ -0,0 +1,288 @@
+package vm
+
+import (
+	"fmt"
+	"lang_vm/code"
+	"lang_vm/compiler"
+	"lang_vm/object"
+)
+
+// VerifyError reports byte code rejected by Verify.
+type VerifyError struct {
+	// Function is "<main>" or the constant holding the function.
+	Function string
+	Offset   int
+	Message  string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("invalid byte code: %s at %04d: %s", e.Function, e.Offset, e.Message)
+}
+
+// Verify checks that byte code is safe to run: every instruction decodes,
+// operands refer to existing constants, locals, free variables and
+// builtins, jumps land on instruction boundaries, functions end in a
+// return and the operand stack never underflows or outgrows the VM stack.
+// Byte code that passes can still fail at run time, but only with a
+// RuntimeError.
+func Verify(byteCode *compiler.ByteCode) error {
+	return verify(byteCode.Instructions, byteCode.Constants)
+}
+
+// Prepared is byte code that passed Verify. Hosts running the same byte
+// code many times prepare it once and create every VM with NewVerified.
+// The byte code must not be changed afterwards.
+type Prepared struct {
+	byteCode *compiler.ByteCode
+}
+
+// Prepare verifies byteCode, see Verify.
+func Prepare(byteCode *compiler.ByteCode) (*Prepared, error) {
+	if err := Verify(byteCode); err != nil {
+		return nil, err
+	}
+
+	return &Prepared{byteCode: byteCode}, nil
+}
+
+// verifiedFunction is a function being verified. numFree is the number of
+// values the function's closures capture.
+type verifiedFunction struct {
+	name      string
+	ins       code.Instructions
+	numLocals int
+	numFree   int
+	isMain    bool
+
+	// instructions holds the decoded instructions by offset, offsets lists
+	// their offsets in order.
+	instructions map[int]decodedInstruction
+	offsets      []int
+}
+
+type decodedInstruction struct {
+	op       code.OpCode
+	operands []int
+	next     int
+}
+
+func verify(main code.Instructions, constants []object.Object) error {
+	functions := []*verifiedFunction{{name: "<main>", ins: main, isMain: true}}
+
+	// functions whose closures are never created keep numFree -1: their
+	// instructions can't run, but are still checked
+	byConstant := make(map[int]*verifiedFunction)
+	for i, constant := range constants {
+		fn, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		f := &verifiedFunction{name: fmt.Sprintf("constant %d", i), ins: fn.Instructions, numLocals: fn.NumLocals, numFree: -1}
+		if fn.NumParameters > fn.NumLocals {
+			return &VerifyError{Function: f.name, Message: fmt.Sprintf("%d parameters but only %d locals", fn.NumParameters, fn.NumLocals)}
+		}
+
+		functions = append(functions, f)
+		byConstant[i] = f
+	}
+
+	for _, f := range functions {
+		if err := f.decode(); err != nil {
+			return err
+		}
+	}
+
+	// a closure has as many free variables as the OpClosure creating it
+	// captures, the smallest count is the one every closure satisfies
+	for _, f := range functions {
+		for _, offset := range f.offsets {
+			ins := f.instructions[offset]
+			if ins.op != code.OpClosure {
+				continue
+			}
+
+			target, ok := byConstant[ins.operands[0]]
+			if !ok {
+				return f.errorf(offset, "constant %d is not a function", ins.operands[0])
+			}
+
+			if target.numFree < 0 || ins.operands[1] < target.numFree {
+				target.numFree = ins.operands[1]
+			}
+		}
+	}
+
+	for _, f := range functions {
+		if err := f.checkStack(constants); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *verifiedFunction) errorf(offset int, format string, a ...interface{}) *VerifyError {
+	return &VerifyError{Function: f.name, Offset: offset, Message: fmt.Sprintf(format, a...)}
+}
+
+// decode splits the instructions, so that later passes only see complete
+// instructions with known opcodes.
+func (f *verifiedFunction) decode() error {
+	f.instructions = make(map[int]decodedInstruction)
+
+	for offset := 0; offset < len(f.ins); {
+		def, err := code.Lookup(f.ins[offset])
+		if err != nil {
+			return f.errorf(offset, "%s", err)
+		}
+
+		if offset+1+def.OperandsWidth() > len(f.ins) {
+			return f.errorf(offset, "truncated %s", def.Name)
+		}
+
+		operands, read := code.ReadOperands(def, f.ins[offset+1:])
+		next := offset + 1 + read
+		f.instructions[offset] = decodedInstruction{op: code.OpCode(f.ins[offset]), operands: operands, next: next}
+		f.offsets = append(f.offsets, offset)
+
+		offset = next
+	}
+
+	return nil
+}
+
+// checkStack interprets the function abstractly, tracking only the depth
+// of the operand stack. Every instruction has to be reached with the same
+// depth on all paths.
+func (f *verifiedFunction) checkStack(constants []object.Object) error {
+	if len(f.ins) == 0 {
+		if f.isMain {
+			return nil
+		}
+		return f.errorf(0, "function has no instructions")
+	}
+
+	depths := map[int]int{0: 0}
+	work := []int{0}
+	maxDepth := 0
+
+	for len(work) > 0 {
+		offset := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		ins := f.instructions[offset]
+		if err := f.checkOperands(offset, ins, constants); err != nil {
+			return err
+		}
+
+		pops, pushes := stackEffect(ins)
+		depth := depths[offset]
+		if depth < pops {
+			return f.errorf(offset, "%s needs %d values, stack holds %d", ins.op, pops, depth)
+		}
+		depth = depth - pops + pushes
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+
+		for _, successor := range successors(ins) {
+			if successor == len(f.ins) {
+				if !f.isMain {
+					return f.errorf(offset, "execution falls off the end of the function")
+				}
+				continue
+			}
+
+			if _, ok := f.instructions[successor]; !ok {
+				return f.errorf(offset, "jump target %04d is not an instruction", successor)
+			}
+
+			seen, ok := depths[successor]
+			if !ok {
+				depths[successor] = depth
+				work = append(work, successor)
+			} else if seen != depth {
+				return f.errorf(successor, "stack depth %d on one path and %d on another", seen, depth)
+			}
+		}
+	}
+
+	if f.numLocals+maxDepth > StackSize {
+		return f.errorf(0, "needs %d stack slots, at most %d are available", f.numLocals+maxDepth, StackSize)
+	}
+
+	return nil
+}
+
+func (f *verifiedFunction) checkOperands(offset int, ins decodedInstruction, constants []object.Object) error {
+	switch ins.op {
+	case code.OpConstant:
+		if ins.operands[0] >= len(constants) {
+			return f.errorf(offset, "constant index %d out of range", ins.operands[0])
+		}
+	case code.OpSetLocal, code.OpGetLocal:
+		if ins.operands[0] >= f.numLocals {
+			return f.errorf(offset, "local index %d out of range, function has %d locals", ins.operands[0], f.numLocals)
+		}
+	case code.OpGetFree:
+		numFree := f.numFree
+		if f.isMain {
+			numFree = 0
+		}
+
+		if numFree >= 0 && ins.operands[0] >= numFree {
+			return f.errorf(offset, "free variable index %d out of range, closure captures %d", ins.operands[0], numFree)
+		}
+	case code.OpGetBuiltin:
+		if _, ok := object.GetBuiltin(ins.operands[0]); !ok {
+			return f.errorf(offset, "undefined builtin %d", ins.operands[0])
+		}
+	case code.OpHash:
+		if ins.operands[0]%2 != 0 {
+			return f.errorf(offset, "odd number of hash elements %d", ins.operands[0])
+		}
+	}
+
+	return nil
+}
+
+// stackEffect returns how many values ins takes from the stack and how
+// many it leaves.
+func stackEffect(ins decodedInstruction) (int, int) {
+	switch ins.op {
+	case code.OpConstant, code.OpNull, code.OpTrue, code.OpFalse, code.OpGetGlobal,
+		code.OpGetLocal, code.OpGetFree, code.OpCurrentClosure, code.OpGetBuiltin:
+		return 0, 1
+	case code.OpPop, code.OpJumpNotTruthy, code.OpSetGlobal, code.OpSetLocal, code.OpReturnValue:
+		return 1, 0
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpGreaterThan, code.OpGreaterThanOrEqual,
+		code.OpLessThan, code.OpLessThanOrEqual, code.OpEqual, code.OpNotEqual, code.OpIndex:
+		return 2, 1
+	case code.OpMinus, code.OpBang:
+		return 1, 1
+	case code.OpArray, code.OpHash:
+		return ins.operands[0], 1
+	case code.OpCall:
+		return ins.operands[0] + 1, 1
+	case code.OpClosure:
+		return ins.operands[1], 1
+	default:
+		// OpJump, OpReturn, OpHalt
+		return 0, 0
+	}
+}
+
+// successors returns the offsets execution can continue at after ins.
+func successors(ins decodedInstruction) []int {
+	switch ins.op {
+	case code.OpJump:
+		return []int{ins.operands[0]}
+	case code.OpJumpNotTruthy:
+		return []int{ins.next, ins.operands[0]}
+	case code.OpReturnValue, code.OpReturn, code.OpHalt:
+		return nil
+	default:
+		return []int{ins.next}
+	}
+}
@@ -0,0 +1,170 @@
+package vm
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"lang_vm/code"
+	"lang_vm/compiler"
+	"lang_vm/object"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	deep := code.NewBuilder()
+	for i := 0; i <= StackSize; i++ {
+		deep.Add(code.OpNull)
+	}
+
+	function := func(numLocals int, b *code.Builder) *object.CompiledFunction {
+		return &object.CompiledFunction{Instructions: b.Build(), NumLocals: numLocals}
+	}
+
+	tests := map[string]struct {
+		ins       code.Instructions
+		constants []object.Object
+		err       string
+	}{
+		"empty": {
+			ins: code.Instructions{},
+		},
+		"valid_function": {
+			ins: code.NewBuilder().Add(code.OpConstant, 0).Add(code.OpClosure, 1, 1).Add(code.OpPop).Build(),
+			constants: []object.Object{
+				&object.Integer{Value: 1},
+				function(1, code.NewBuilder().Add(code.OpGetFree, 0).Add(code.OpGetLocal, 0).Add(code.OpAdd).Add(code.OpReturnValue)),
+			},
+		},
+		"unknown_opcode": {
+			ins: code.Instructions{255},
+			err: "invalid byte code: <main> at 0000: unknown opcode 0xff",
+		},
+		"truncated_operand": {
+			ins: code.NewBuilder().Add(code.OpTrue).Add(code.OpConstant, 0).Build()[:3],
+			err: "invalid byte code: <main> at 0001: truncated OpConstant",
+		},
+		"constant_out_of_range": {
+			ins:       code.NewBuilder().Add(code.OpConstant, 1).Build(),
+			constants: []object.Object{&object.Integer{Value: 1}},
+			err:       "invalid byte code: <main> at 0000: constant index 1 out of range",
+		},
+		"jump_into_operand": {
+			ins:       code.NewBuilder().Add(code.OpConstant, 0).Add(code.OpJump, 1).Build(),
+			constants: []object.Object{&object.Integer{Value: 1}},
+			err:       "invalid byte code: <main> at 0003: jump target 0001 is not an instruction",
+		},
+		"jump_past_end": {
+			ins: code.NewBuilder().Add(code.OpJump, 10).Build(),
+			err: "invalid byte code: <main> at 0000: jump target 0010 is not an instruction",
+		},
+		"stack_underflow": {
+			ins: code.NewBuilder().Add(code.OpTrue).Add(code.OpAdd).Build(),
+			err: "invalid byte code: <main> at 0001: OpAdd needs 2 values, stack holds 1",
+		},
+		"inconsistent_depth": {
+			ins: code.NewBuilder().Add(code.OpTrue).Add(code.OpJumpNotTruthy, 5).Add(code.OpTrue).Add(code.OpHalt).Build(),
+			err: "invalid byte code: <main> at 0005: stack depth 0 on one path and 1 on another",
+		},
+		"stack_too_deep": {
+			ins: deep.Build(),
+			err: "invalid byte code: <main> at 0000: needs 2049 stack slots, at most 2048 are available",
+		},
+		"local_in_main": {
+			ins: code.NewBuilder().Add(code.OpGetLocal, 0).Build(),
+			err: "invalid byte code: <main> at 0000: local index 0 out of range, function has 0 locals",
+		},
+		"free_in_main": {
+			ins: code.NewBuilder().Add(code.OpGetFree, 0).Build(),
+			err: "invalid byte code: <main> at 0000: free variable index 0 out of range, closure captures 0",
+		},
+		"undefined_builtin": {
+			ins: code.NewBuilder().Add(code.OpGetBuiltin, 255).Build(),
+			err: "invalid byte code: <main> at 0000: undefined builtin 255",
+		},
+		"odd_hash": {
+			ins: code.NewBuilder().Add(code.OpTrue).Add(code.OpHash, 1).Build(),
+			err: "invalid byte code: <main> at 0001: odd number of hash elements 1",
+		},
+		"closure_of_non_function": {
+			ins:       code.NewBuilder().Add(code.OpClosure, 0, 0).Build(),
+			constants: []object.Object{&object.Integer{Value: 1}},
+			err:       "invalid byte code: <main> at 0000: constant 0 is not a function",
+		},
+		"closure_missing_free_values": {
+			ins:       code.NewBuilder().Add(code.OpClosure, 0, 1).Build(),
+			constants: []object.Object{function(0, code.NewBuilder().Add(code.OpReturn))},
+			err:       "invalid byte code: <main> at 0000: OpClosure needs 1 values, stack holds 0",
+		},
+		"function_falls_off_end": {
+			ins:       code.NewBuilder().Add(code.OpClosure, 0, 0).Build(),
+			constants: []object.Object{function(0, code.NewBuilder().Add(code.OpNull))},
+			err:       "invalid byte code: constant 0 at 0000: execution falls off the end of the function",
+		},
+		"function_empty": {
+			constants: []object.Object{function(0, code.NewBuilder())},
+			err:       "invalid byte code: constant 0 at 0000: function has no instructions",
+		},
+		"function_local_out_of_range": {
+			constants: []object.Object{function(1, code.NewBuilder().Add(code.OpGetLocal, 1).Add(code.OpReturnValue))},
+			err:       "invalid byte code: constant 0 at 0000: local index 1 out of range, function has 1 locals",
+		},
+		"function_free_out_of_range": {
+			ins:       code.NewBuilder().Add(code.OpNull).Add(code.OpClosure, 0, 1).Build(),
+			constants: []object.Object{function(0, code.NewBuilder().Add(code.OpGetFree, 1).Add(code.OpReturnValue))},
+			err:       "invalid byte code: constant 0 at 0000: free variable index 1 out of range, closure captures 1",
+		},
+		"function_parameters_exceed_locals": {
+			constants: []object.Object{&object.CompiledFunction{Instructions: code.NewBuilder().Add(code.OpReturn).Build(), NumParameters: 1}},
+			err:       "invalid byte code: constant 0 at 0000: 1 parameters but only 0 locals",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := Verify(&compiler.ByteCode{Instructions: tc.ins, Constants: tc.constants})
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestVerifyCompiledPrograms(t *testing.T) {
+	inputs := []string{
+		"if (1 > 2) { 10 } else { 20 }; if (true) { }",
+		"let f = fn(a) { let b = fn(c) { a + c }; b(2) }; f(1)",
+		`let fib = fn(n) { if (n < 2) { return n; } fib(n - 1) + fib(n - 2) }; fib(5)`,
+		`[1, 2][0] + {"a": len("x")}["a"]`,
+	}
+
+	for _, input := range inputs {
+		assert.NoError(t, Verify(compileSource(t, input)), input)
+	}
+}
+
+func TestRunRejectsInvalidByteCode(t *testing.T) {
+	vm := New(&compiler.ByteCode{Instructions: code.NewBuilder().Add(code.OpConstant, 0).Build()})
+
+	err := vm.Run()
+
+	var verifyErr *VerifyError
+	assert.True(t, errors.As(err, &verifyErr))
+	assert.Equal(t, 0, vm.sp)
+}
+
+func TestPrepare(t *testing.T) {
+	_, err := Prepare(&compiler.ByteCode{Instructions: code.NewBuilder().Add(code.OpConstant, 0).Build()})
+
+	var verifyErr *VerifyError
+	assert.True(t, errors.As(err, &verifyErr))
+
+	prepared, err := Prepare(compileSource(t, "let a = 2; a * 21"))
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		vm := NewVerified(prepared, make([]object.Object, 1))
+		assert.NoError(t, vm.Run())
+		assert.Equal(t, &object.Integer{Value: 42}, vm.LastPoppedStackElem())
+	}
+}
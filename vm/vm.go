@@ -1,50 +1,368 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"lang_vm/code"
+	"lang_vm/compiler"
 	"lang_vm/object"
+	"os"
 )
 
 const (
-	maxStackSize = 2048
+	// StackSize is the number of operand stack slots, which also hold the
+	// locals of active calls.
+	StackSize = 2048
+
+	// MaxFrames bounds the depth of nested function calls.
+	MaxFrames = 1024
+
+	// GlobalsSize is the number of global slots addressable by OpSetGlobal
+	// and OpGetGlobal.
+	GlobalsSize = 65536
+)
+
+var (
+	True  = &object.Boolean{Value: true}
+	False = &object.Boolean{Value: false}
+	Null  = &object.Null{}
 )
 
 type VM struct {
-	ins   code.Instructions
-	stack []object.Object
-	sp    int
-	ip    int
+	constants []object.Object
+	stack     []object.Object
+	globals   []object.Object
+	sp        int
+
+	frames      []*Frame
+	framesIndex int
+
+	// verified is set once the byte code passed Verify.
+	verified bool
+
+	limits       Limits
+	instructions int64
+	heapBytes    int64
+
+	// out is where builtins like puts print to.
+	out io.Writer
+}
+
+func New(byteCode *compiler.ByteCode) *VM {
+	return NewWithGlobalsStore(byteCode, make([]object.Object, GlobalsSize))
+}
+
+// NewWithGlobalsStore returns a VM that reads and writes globals in s, so
+// that globals survive across runs of successive byte codes. s needs a slot
+// for every global the byte code uses, using one beyond fails the run.
+func NewWithGlobalsStore(byteCode *compiler.ByteCode, s []object.Object) *VM {
+	mainFn := &object.CompiledFunction{Instructions: byteCode.Instructions, Positions: byteCode.Positions}
+	mainClosure := &object.Closure{Fn: mainFn}
+
+	frames := make([]*Frame, MaxFrames)
+	frames[0] = NewFrame(mainClosure, 0)
+
+	vm := &VM{
+		constants:   byteCode.Constants,
+		stack:       make([]object.Object, StackSize),
+		globals:     s,
+		sp:          0,
+		frames:      frames,
+		framesIndex: 1,
+		out:         os.Stdout,
+	}
+	vm.SetLimits(Limits{})
+
+	return vm
+}
+
+// NewVerified is NewWithGlobalsStore for byte code that was verified by
+// Prepare, which isn't verified again.
+func NewVerified(prepared *Prepared, s []object.Object) *VM {
+	vm := NewWithGlobalsStore(prepared.byteCode, s)
+	vm.verified = true
+
+	return vm
+}
+
+// SetOutput makes builtins like puts print to out instead of os.Stdout.
+func (vm *VM) SetOutput(out io.Writer) {
+	vm.out = out
+}
+
+func (vm *VM) currentFrame() *Frame {
+	return vm.frames[vm.framesIndex-1]
 }
 
-func New(ins code.Instructions) *VM {
-	return &VM{
-		ins:   ins,
-		stack: make([]object.Object, maxStackSize),
-		sp:    0,
-		ip:    0,
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.framesIndex > vm.limits.MaxCallDepth {
+		return fmt.Errorf("%w: more than %d nested calls", ErrCallDepthLimit, vm.limits.MaxCallDepth)
 	}
+
+	vm.frames[vm.framesIndex] = f
+	vm.framesIndex++
+	return nil
+}
+
+func (vm *VM) popFrame() *Frame {
+	vm.framesIndex--
+	return vm.frames[vm.framesIndex]
 }
 
+// Run executes the byte code. Byte code that fails Verify is rejected with
+// a *VerifyError before anything runs, failures while running, including
+// exceeding the limits set by SetLimits, are reported as a *RuntimeError.
 func (vm *VM) Run() error {
+	return vm.RunContext(context.Background())
+}
+
+// RunContext is Run, stopping with ErrCancelled or ErrDeadline, wrapped in a
+// *RuntimeError, once ctx is done. The VM notices within checkInterval
+// instructions and before every call and backward jump, so loops and
+// recursion can't escape it. The VM stops before the instruction it was
+// about to execute, its stack is left as it is, and running it again
+// continues from there.
+func (vm *VM) RunContext(ctx context.Context) error {
+	if !vm.verified {
+		if err := verify(vm.frames[0].Instructions(), vm.constants); err != nil {
+			return err
+		}
+		vm.verified = true
+	}
+
 	var err error
+	var opcode code.OpCode
+	var ip int
 	running := true
 
-	for running {
-		opcode := code.OpCode(vm.ins[vm.ip])
-		vm.ip++
+	// a nil channel means ctx can't be cancelled
+	done := ctx.Done()
+	executed := 0
+
+	for running && vm.currentFrame().ip < len(vm.currentFrame().Instructions()) {
+		frame := vm.currentFrame()
+		ins := frame.Instructions()
+
+		ip = frame.ip
+		opcode = code.OpCode(ins[frame.ip])
+
+		if done != nil && (executed%checkInterval == 0 || isCheckpoint(ins, ip)) {
+			if err = checkContext(ctx, done); err != nil {
+				break
+			}
+		}
+		executed++
+
+		if err = vm.countInstruction(); err != nil {
+			break
+		}
+		frame.ip++
 		switch opcode {
 
 		case code.OpConstant:
-			val := code.ReadUint16(vm.ins[vm.ip:])
-			vm.ip += 2
-			err = vm.push(&object.Integer{Value: int64(val)})
+			idx := int(code.ReadUint16(ins[frame.ip:]))
+			frame.ip += 2
+			if idx >= len(vm.constants) {
+				err = fmt.Errorf("constant index %d out of range", idx)
+				running = false
+				break
+			}
+
+			err = vm.push(vm.constants[idx])
+			if err != nil {
+				running = false
+			}
+
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+			if err = vm.executeBinaryOperation(opcode); err != nil {
+				running = false
+			}
+
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanOrEqual,
+			code.OpLessThan, code.OpLessThanOrEqual:
+			if err = vm.executeComparison(opcode); err != nil {
+				running = false
+			}
+
+		case code.OpMinus:
+			if err = vm.executeMinusOperator(); err != nil {
+				running = false
+			}
+
+		case code.OpBang:
+			operand := vm.Pop()
+			if err = vm.push(nativeBoolToBooleanObject(!isTruthy(operand))); err != nil {
+				running = false
+			}
+
+		case code.OpJump:
+			pos := int(code.ReadUint16(ins[frame.ip:]))
+			frame.ip = pos
+
+		case code.OpJumpNotTruthy:
+			pos := int(code.ReadUint16(ins[frame.ip:]))
+			frame.ip += 2
+
+			condition := vm.Pop()
+			if !isTruthy(condition) {
+				frame.ip = pos
+			}
+
+		case code.OpNull:
+			if err = vm.push(Null); err != nil {
+				running = false
+			}
+
+		case code.OpTrue:
+			if err = vm.push(True); err != nil {
+				running = false
+			}
+
+		case code.OpFalse:
+			if err = vm.push(False); err != nil {
+				running = false
+			}
+
+		case code.OpPop:
+			vm.Pop()
+
+		case code.OpArray:
+			numElements := int(code.ReadUint16(ins[frame.ip:]))
+			frame.ip += 2
+
+			array := vm.buildArray(vm.sp-numElements, vm.sp)
+			vm.sp = vm.sp - numElements
+
+			if err = vm.pushAllocated(array); err != nil {
+				running = false
+			}
+
+		case code.OpHash:
+			numElements := int(code.ReadUint16(ins[frame.ip:]))
+			frame.ip += 2
+
+			var hash object.Object
+			hash, err = vm.buildHash(vm.sp-numElements, vm.sp)
 			if err != nil {
 				running = false
+				break
+			}
+			vm.sp = vm.sp - numElements
+
+			if err = vm.pushAllocated(hash); err != nil {
+				running = false
+			}
+
+		case code.OpIndex:
+			index := vm.Pop()
+			left := vm.Pop()
+
+			if err = vm.executeIndexExpression(left, index); err != nil {
+				running = false
+			}
+
+		case code.OpSetGlobal:
+			idx := int(code.ReadUint16(ins[frame.ip:]))
+			frame.ip += 2
+
+			if idx >= len(vm.globals) {
+				err = globalOutOfRange(idx, len(vm.globals))
+				running = false
+				break
+			}
+
+			vm.globals[idx] = vm.Pop()
+
+		case code.OpGetGlobal:
+			idx := int(code.ReadUint16(ins[frame.ip:]))
+			frame.ip += 2
+
+			if idx >= len(vm.globals) {
+				err = globalOutOfRange(idx, len(vm.globals))
+				running = false
+				break
+			}
+
+			// a global is unset if the run defining it failed, e.g. in a REPL
+			if vm.globals[idx] == nil {
+				err = fmt.Errorf("global %d is used before it is set", idx)
+				running = false
+				break
+			}
+
+			if err = vm.push(vm.globals[idx]); err != nil {
+				running = false
+			}
+
+		case code.OpSetLocal:
+			idx := int(code.ReadUint8(ins[frame.ip:]))
+			frame.ip += 1
+
+			vm.stack[frame.basePointer+idx] = vm.Pop()
+
+		case code.OpGetLocal:
+			idx := int(code.ReadUint8(ins[frame.ip:]))
+			frame.ip += 1
+
+			if err = vm.push(vm.stack[frame.basePointer+idx]); err != nil {
+				running = false
+			}
+
+		case code.OpGetBuiltin:
+			idx := int(code.ReadUint8(ins[frame.ip:]))
+			frame.ip += 1
+
+			builtin, ok := object.GetBuiltin(idx)
+			if !ok {
+				err = fmt.Errorf("undefined builtin %d", idx)
+				running = false
+				break
+			}
+
+			if err = vm.push(builtin); err != nil {
+				running = false
+			}
+
+		case code.OpCall:
+			numArgs := int(code.ReadUint8(ins[frame.ip:]))
+			frame.ip += 1
+
+			if err = vm.callFunction(numArgs); err != nil {
+				running = false
+			}
+
+		case code.OpReturnValue:
+			returnValue := vm.Pop()
+
+			if err = vm.returnFromFunction(returnValue); err != nil {
+				running = false
+			}
+
+		case code.OpReturn:
+			if err = vm.returnFromFunction(Null); err != nil {
+				running = false
 			}
 
-		case code.OpAdd:
-			if err = vm.add(); err != nil {
+		case code.OpClosure:
+			idx := int(code.ReadUint16(ins[frame.ip:]))
+			numFree := int(code.ReadUint8(ins[frame.ip+2:]))
+			frame.ip += 3
+
+			if err = vm.pushClosure(idx, numFree); err != nil {
+				running = false
+			}
+
+		case code.OpGetFree:
+			idx := int(code.ReadUint8(ins[frame.ip:]))
+			frame.ip += 1
+
+			if err = vm.push(frame.cl.Free[idx]); err != nil {
+				running = false
+			}
+
+		case code.OpCurrentClosure:
+			if err = vm.push(frame.cl); err != nil {
 				running = false
 			}
 
@@ -57,19 +375,133 @@ func (vm *VM) Run() error {
 		}
 	}
 
-	return err
+	if err != nil {
+		return vm.newRuntimeError(err, opcode, ip)
+	}
+
+	return nil
+}
+
+// callFunction calls the function sitting below its numArgs arguments on
+// the stack. The arguments become the callee's first locals.
+func (vm *VM) callFunction(numArgs int) error {
+	switch callee := vm.stack[vm.sp-1-numArgs].(type) {
+	case *object.Closure:
+		return vm.callClosure(callee, numArgs)
+	case *object.Builtin:
+		return vm.callBuiltin(callee, numArgs)
+	default:
+		return fmt.Errorf("calling non-function: %s", callee.Type())
+	}
+}
+
+func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
+	if numArgs != cl.Fn.NumParameters {
+		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
+	}
+
+	frame := NewFrame(cl, vm.sp-numArgs)
+	if frame.basePointer+cl.Fn.NumLocals > vm.limits.MaxStackSize {
+		return vm.stackLimitError()
+	}
+
+	if err := vm.pushFrame(frame); err != nil {
+		return err
+	}
+	vm.sp = frame.basePointer + cl.Fn.NumLocals
+
+	// a local can be read before its let statement runs, e.g. if it is
+	// defined in a branch not taken. It reads as null rather than whatever
+	// an earlier call left in its slot.
+	for i := frame.basePointer + cl.Fn.NumParameters; i < vm.sp; i++ {
+		vm.stack[i] = Null
+	}
+
+	return nil
+}
+
+// callBuiltin replaces the builtin and its arguments on the stack with the
+// result. An *object.Error result stops the VM. The builtin gets a copy of
+// its arguments, as it may keep or append to them.
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
+	args := make([]object.Object, numArgs)
+	copy(args, vm.stack[vm.sp-numArgs:vm.sp])
+
+	var result object.Object
+	if builtin.Output != nil {
+		result = builtin.Output(vm.out, args...)
+	} else {
+		result = builtin.Fn(args...)
+	}
+	vm.sp = vm.sp - numArgs - 1
+
+	if err, ok := result.(*object.Error); ok {
+		return fmt.Errorf("%s", err.Message)
+	}
+
+	if result == nil {
+		return vm.push(Null)
+	}
+
+	return vm.pushAllocated(result)
+}
+
+// pushClosure wraps the function constant at constIdx into a closure that
+// captures the numFree values on top of the stack.
+func (vm *VM) pushClosure(constIdx int, numFree int) error {
+	if constIdx >= len(vm.constants) {
+		return fmt.Errorf("constant index %d out of range", constIdx)
+	}
+
+	fn, ok := vm.constants[constIdx].(*object.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a function: %s", vm.constants[constIdx].Type())
+	}
+
+	free := make([]object.Object, numFree)
+	copy(free, vm.stack[vm.sp-numFree:vm.sp])
+	vm.sp -= numFree
+
+	return vm.pushAllocated(&object.Closure{Fn: fn, Free: free})
+}
+
+// returnFromFunction discards the current frame together with the callee
+// on the stack and pushes returnValue in its place.
+func (vm *VM) returnFromFunction(returnValue object.Object) error {
+	if vm.framesIndex == 1 {
+		return fmt.Errorf("return outside of function")
+	}
+
+	frame := vm.popFrame()
+	vm.sp = frame.basePointer - 1
+
+	return vm.push(returnValue)
 }
 
 func (vm *VM) push(o object.Object) error {
-	vm.stack[vm.sp] = o
-	if vm.sp-1 >= maxStackSize {
-		return fmt.Errorf("stack overflow")
+	if vm.sp >= vm.limits.MaxStackSize {
+		return vm.stackLimitError()
 	}
 
+	vm.stack[vm.sp] = o
 	vm.sp++
 	return nil
 }
 
+// pushAllocated pushes a value created by the VM, charging it to the heap
+// budget.
+func (vm *VM) pushAllocated(o object.Object) error {
+	if err := vm.allocate(o); err != nil {
+		return err
+	}
+
+	return vm.push(o)
+}
+
+func (vm *VM) stackLimitError() error {
+	return fmt.Errorf("%w: more than %d stack slots", ErrStackLimit, vm.limits.MaxStackSize)
+}
+
 func (vm *VM) Pop() object.Object {
 	vm.sp--
 	o := vm.stack[vm.sp]
@@ -77,22 +509,198 @@ func (vm *VM) Pop() object.Object {
 	return o
 }
 
-func (vm *VM) add() error {
-	a := vm.Pop()
-	b := vm.Pop()
+// LastPoppedStackElem returns the value most recently removed from the
+// stack, which is the result of the last expression statement.
+func (vm *VM) LastPoppedStackElem() object.Object {
+	return vm.stack[vm.sp]
+}
+
+func (vm *VM) executeBinaryOperation(op code.OpCode) error {
+	right := vm.Pop()
+	left := vm.Pop()
 
-	temp := object.Integer{Value: 0}
+	if left.Type() == object.StringObj && right.Type() == object.StringObj {
+		return vm.executeBinaryStringOperation(op, left.(*object.String), right.(*object.String))
+	}
 
-	if a.Type() != temp.Type() || b.Type() != temp.Type() {
-		return fmt.Errorf("%v or %v is not of integer type", a.Inspect(), b.Inspect())
+	l, lok := left.(*object.Integer)
+	r, rok := right.(*object.Integer)
+	if !lok || !rok {
+		return fmt.Errorf("%v or %v is not of integer type", left.Inspect(), right.Inspect())
 	}
 
-	c := a.(*object.Integer).Value + b.(*object.Integer).Value
-	o := &object.Integer{Value: c}
+	var result int64
 
-	if err := vm.push(o); err != nil {
-		return err
+	switch op {
+	case code.OpAdd:
+		result = l.Value + r.Value
+	case code.OpSub:
+		result = l.Value - r.Value
+	case code.OpMul:
+		result = l.Value * r.Value
+	case code.OpDiv:
+		if r.Value == 0 {
+			return fmt.Errorf("division by zero: %d / %d", l.Value, r.Value)
+		}
+		result = l.Value / r.Value
+	default:
+		return fmt.Errorf("unknown integer operator: %s", op)
 	}
 
-	return nil
+	return vm.pushAllocated(&object.Integer{Value: result})
+}
+
+func (vm *VM) executeBinaryStringOperation(op code.OpCode, left, right *object.String) error {
+	if op != code.OpAdd {
+		return fmt.Errorf("unknown string operator: %s", op)
+	}
+
+	return vm.pushAllocated(&object.String{Value: left.Value + right.Value})
+}
+
+func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
+	elements := make([]object.Object, endIndex-startIndex)
+	copy(elements, vm.stack[startIndex:endIndex])
+
+	return &object.Array{Elements: elements}
+}
+
+// buildHash builds a hash from the key value pairs on the stack between
+// startIndex and endIndex. Later pairs override earlier ones with the same key.
+func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
+	hash := object.NewHash()
+
+	for i := startIndex; i < endIndex; i += 2 {
+		key, ok := vm.stack[i].(object.Hashable)
+		if !ok {
+			return nil, fmt.Errorf("unusable as hash key: %s", vm.stack[i].Type())
+		}
+
+		hash.Set(key, vm.stack[i+1])
+	}
+
+	return hash, nil
+}
+
+func (vm *VM) executeIndexExpression(left, index object.Object) error {
+	switch {
+	case left.Type() == object.ArrayObj && index.Type() == object.IntegerObj:
+		return vm.executeArrayIndex(left.(*object.Array), index.(*object.Integer).Value)
+	case left.Type() == object.HashObj:
+		return vm.executeHashIndex(left.(*object.Hash), index)
+	default:
+		return fmt.Errorf("index operator not supported: %s[%s]", left.Type(), index.Type())
+	}
+}
+
+// executeArrayIndex pushes the element at idx. Negative indexes count from
+// the end, so -1 is the last element. Indexes outside the array yield null.
+func (vm *VM) executeArrayIndex(array *object.Array, idx int64) error {
+	length := int64(len(array.Elements))
+	if idx < 0 {
+		idx += length
+	}
+
+	if idx < 0 || idx >= length {
+		return vm.push(Null)
+	}
+
+	return vm.push(array.Elements[idx])
+}
+
+// executeHashIndex pushes the value stored under index, or null if the
+// hash has no such key.
+func (vm *VM) executeHashIndex(hash *object.Hash, index object.Object) error {
+	key, ok := index.(object.Hashable)
+	if !ok {
+		return fmt.Errorf("unusable as hash key: %s", index.Type())
+	}
+
+	value, ok := hash.Get(key)
+	if !ok {
+		return vm.push(Null)
+	}
+
+	return vm.push(value)
+}
+
+func (vm *VM) executeMinusOperator() error {
+	operand := vm.Pop()
+
+	integer, ok := operand.(*object.Integer)
+	if !ok {
+		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
+	}
+
+	return vm.pushAllocated(&object.Integer{Value: -integer.Value})
+}
+
+func (vm *VM) executeComparison(op code.OpCode) error {
+	right := vm.Pop()
+	left := vm.Pop()
+
+	l, lok := left.(*object.Integer)
+	r, rok := right.(*object.Integer)
+
+	var result bool
+
+	switch {
+	case lok && rok:
+		switch op {
+		case code.OpEqual:
+			result = l.Value == r.Value
+		case code.OpNotEqual:
+			result = l.Value != r.Value
+		case code.OpGreaterThan:
+			result = l.Value > r.Value
+		case code.OpGreaterThanOrEqual:
+			result = l.Value >= r.Value
+		case code.OpLessThan:
+			result = l.Value < r.Value
+		case code.OpLessThanOrEqual:
+			result = l.Value <= r.Value
+		}
+
+	case left.Type() == object.StringObj && right.Type() == object.StringObj &&
+		(op == code.OpEqual || op == code.OpNotEqual):
+		equal := left.(*object.String).Value == right.(*object.String).Value
+		result = equal == (op == code.OpEqual)
+
+	case op == code.OpEqual:
+		result = left == right
+	case op == code.OpNotEqual:
+		result = left != right
+
+	default:
+		return fmt.Errorf("unknown operator: %s (%s %s)", op, left.Type(), right.Type())
+	}
+
+	return vm.push(nativeBoolToBooleanObject(result))
+}
+
+func nativeBoolToBooleanObject(b bool) *object.Boolean {
+	if b {
+		return True
+	}
+
+	return False
+}
+
+// isTruthy reports whether obj counts as true in a conditional. False,
+// null and the integer zero are false, everything else is true.
+func isTruthy(obj object.Object) bool {
+	switch obj := obj.(type) {
+	case *object.Boolean:
+		return obj.Value
+	case *object.Null:
+		return false
+	case *object.Integer:
+		return obj.Value != 0
+	default:
+		return true
+	}
+}
+
+func globalOutOfRange(idx, size int) error {
+	return fmt.Errorf("global %d out of range, the globals store has %d slots", idx, size)
 }
@@ -1,33 +1,58 @@
 package vm
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
 	"lang_vm/code"
+	"lang_vm/compiler"
+	"lang_vm/lexer"
 	"lang_vm/object"
+	"lang_vm/parser"
 	"testing"
 )
 
 func TestVmAdd(t *testing.T) {
 	type testCase struct {
-		ins code.Instructions
-		out object.Object
+		byteCode *compiler.ByteCode
+		out      object.Object
 	}
 
 	testCases := map[string]testCase{
 		"add_two_nums": {
-			ins: code.NewBuilder().
-				Add(code.OpConstant, 1).
-				Add(code.OpConstant, 3).
-				Add(code.OpAdd).
-				Add(code.OpHalt).
-				Build(),
+			byteCode: &compiler.ByteCode{
+				Instructions: code.NewBuilder().
+					Add(code.OpConstant, 0).
+					Add(code.OpConstant, 1).
+					Add(code.OpAdd).
+					Add(code.OpHalt).
+					Build(),
+				Constants: []object.Object{
+					&object.Integer{Value: 1},
+					&object.Integer{Value: 3},
+				},
+			},
 			out: &object.Integer{Value: 4},
 		},
+		"add_large_and_negative_nums": {
+			byteCode: &compiler.ByteCode{
+				Instructions: code.NewBuilder().
+					Add(code.OpConstant, 0).
+					Add(code.OpConstant, 1).
+					Add(code.OpAdd).
+					Add(code.OpHalt).
+					Build(),
+				Constants: []object.Object{
+					&object.Integer{Value: 1 << 40},
+					&object.Integer{Value: -5},
+				},
+			},
+			out: &object.Integer{Value: 1<<40 - 5},
+		},
 	}
 
 	for name, tc := range testCases {
 		t.Run(name, func(t *testing.T) {
-			vm := New(tc.ins)
+			vm := New(tc.byteCode)
 
 			err := vm.Run()
 			assert.NoError(t, err, name)
@@ -37,3 +62,432 @@ func TestVmAdd(t *testing.T) {
 		})
 	}
 }
+
+// assemble builds byte code from a code.Assemble listing.
+func assemble(t *testing.T, listing string) *compiler.ByteCode {
+	t.Helper()
+
+	asm, err := code.Assemble(listing)
+	assert.NoError(t, err)
+
+	constants := make([]object.Object, 0, len(asm.Constants))
+	for _, c := range asm.Constants {
+		switch c := c.(type) {
+		case int64:
+			constants = append(constants, &object.Integer{Value: c})
+		case string:
+			constants = append(constants, &object.String{Value: c})
+		}
+	}
+
+	return &compiler.ByteCode{Instructions: asm.Instructions, Constants: constants}
+}
+
+func TestVmAssembled(t *testing.T) {
+	testCases := map[string]struct {
+		listing string
+		out     object.Object
+	}{
+		"loop": {
+			// the language has no loops, but the VM runs them
+			listing: `
+				.const zero 0
+				.const one 1
+				.const ten 10
+
+					OpConstant zero
+					OpSetGlobal 0 ; sum
+					OpConstant ten
+					OpSetGlobal 1 ; n
+				loop:
+					OpGetGlobal 1
+					OpJumpNotTruthy done
+					OpGetGlobal 0
+					OpGetGlobal 1
+					OpAdd
+					OpSetGlobal 0
+					OpGetGlobal 1
+					OpConstant one
+					OpSub
+					OpSetGlobal 1
+					OpJump loop
+				done:
+					OpGetGlobal 0
+					OpPop`,
+			out: &object.Integer{Value: 55},
+		},
+		"strings": {
+			listing: `
+				.const "a;b"
+				.const "\n"
+					OpConstant 0
+					OpConstant 1
+					OpAdd
+					OpPop`,
+			out: &object.String{Value: "a;b\n"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			vm := New(assemble(t, tc.listing))
+
+			assert.NoError(t, vm.Run())
+			assert.Equal(t, tc.out, vm.LastPoppedStackElem())
+		})
+	}
+}
+
+func TestVmUnsetLocal(t *testing.T) {
+	// byte code reading a local it never set passes Verify
+	byteCode := assemble(t, `
+		.const 0
+		OpClosure 0 0
+		OpCall 0
+		OpPop`)
+	byteCode.Constants = []object.Object{&object.CompiledFunction{
+		Instructions: code.NewBuilder().Add(code.OpGetLocal, 1).Add(code.OpReturnValue).Build(),
+		NumLocals:    2,
+	}}
+
+	vm := New(byteCode)
+	assert.NoError(t, vm.Run())
+	assert.Equal(t, Null, vm.LastPoppedStackElem())
+}
+
+func TestVmUnsetGlobal(t *testing.T) {
+	vm := New(assemble(t, `
+		OpGetGlobal 3
+		OpPop`))
+
+	assert.EqualError(t, vm.Run(), "global 3 is used before it is set")
+}
+
+func init() {
+	// a host defined builtin, registered the way an embedding application would
+	err := object.RegisterBuiltin("double", func(args ...object.Object) object.Object {
+		return &object.Integer{Value: 2 * args[0].(*object.Integer).Value}
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// kept holds the arguments of the last call to the builtin keep.
+var kept []object.Object
+
+func init() {
+	err := object.RegisterBuiltin("keep", func(args ...object.Object) object.Object {
+		kept = args
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestVmBuiltinKeepsArguments(t *testing.T) {
+	vm := New(compileSource(t, "keep(1, 2); let y = [9, 9, 9]; 5"))
+	assert.NoError(t, vm.Run())
+
+	assert.Equal(t, []object.Object{&object.Integer{Value: 1}, &object.Integer{Value: 2}}, kept)
+	assert.Equal(t, 2, cap(kept))
+}
+
+func compileSource(t *testing.T, input string) *compiler.ByteCode {
+	t.Helper()
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	assert.Empty(t, p.Errors())
+
+	c := compiler.NewCompiler()
+	assert.NoError(t, c.Compile(program))
+
+	return c.ByteCode()
+}
+
+func TestVmRun(t *testing.T) {
+	type testCase struct {
+		input string
+		out   object.Object
+	}
+
+	testCases := map[string]testCase{
+		"integer":                     {input: "7", out: &object.Integer{Value: 7}},
+		"add":                         {input: "1 + 2", out: &object.Integer{Value: 3}},
+		"sub_operand_order":           {input: "1 - 2", out: &object.Integer{Value: -1}},
+		"mul":                         {input: "4 * 5", out: &object.Integer{Value: 20}},
+		"div_operand_order":           {input: "10 / 4", out: &object.Integer{Value: 2}},
+		"precedence":                  {input: "2 * (5 + 10)", out: &object.Integer{Value: 30}},
+		"mixed":                       {input: "5 * 2 + 10 - 50 / 5", out: &object.Integer{Value: 10}},
+		"last_statement":              {input: "1; 2; 3", out: &object.Integer{Value: 3}},
+		"if_truthy":                   {input: "if (1) { 10 }", out: &object.Integer{Value: 10}},
+		"if_else_truthy":              {input: "if (1) { 10 } else { 20 }", out: &object.Integer{Value: 10}},
+		"if_else_falsy":               {input: "if (0) { 10 } else { 20 }", out: &object.Integer{Value: 20}},
+		"if_falsy_no_else":            {input: "if (0) { 10 }", out: Null},
+		"if_null_condition":           {input: "if (if (0) { 1 }) { 10 } else { 20 }", out: &object.Integer{Value: 20}},
+		"if_multiple_in_block":        {input: "if (5 + 10) { 4 + 5 } else { 99 + 99; 55 - 8 }", out: &object.Integer{Value: 9}},
+		"if_else_block_value":         {input: "if (5 - 5) { 4 + 5 } else { 99 + 99; 55 - 8 }", out: &object.Integer{Value: 47}},
+		"if_empty_block":              {input: "if (1) { }", out: Null},
+		"true":                        {input: "true", out: True},
+		"false":                       {input: "false", out: False},
+		"if_true":                     {input: "if (true) { 10 } else { 20 }", out: &object.Integer{Value: 10}},
+		"if_false":                    {input: "if (false) { 10 } else { 20 }", out: &object.Integer{Value: 20}},
+		"if_false_no_else":            {input: "if (false) { 10 }", out: Null},
+		"if_boolean_value":            {input: "if (1) { true } else { false }", out: True},
+		"global_let":                  {input: "let one = 1; one", out: &object.Integer{Value: 1}},
+		"global_let_multiple":         {input: "let one = 1; let two = one + one; one + two", out: &object.Integer{Value: 3}},
+		"global_let_redefine":         {input: "let a = 1; let a = a + 10; a", out: &object.Integer{Value: 11}},
+		"if_with_let":                 {input: "let t = true; if (t) { let x = 5; }", out: Null},
+		"call_no_args":                {input: "let f = fn() { 5 + 10 }; f()", out: &object.Integer{Value: 15}},
+		"call_chain":                  {input: "let one = fn() { 1 }; let two = fn() { one() + one() }; two() + one()", out: &object.Integer{Value: 3}},
+		"call_immediately":            {input: "fn() { 7 }()", out: &object.Integer{Value: 7}},
+		"call_early_return":           {input: "let f = fn() { return 99; 100 }; f()", out: &object.Integer{Value: 99}},
+		"call_return_in_if":           {input: "let f = fn(x) { if (x) { return 1; } return 2; }; f(0)", out: &object.Integer{Value: 2}},
+		"call_empty_body":             {input: "let f = fn() { }; f()", out: Null},
+		"call_let_last":               {input: "let f = fn() { let a = 1; }; f()", out: Null},
+		"call_arguments":              {input: "let sub = fn(a, b) { a - b }; sub(10, 3)", out: &object.Integer{Value: 7}},
+		"call_locals":                 {input: "let f = fn(a) { let b = a * 2; let c = b + 1; c }; f(4)", out: &object.Integer{Value: 9}},
+		"call_local_unset":            {input: "let f = fn() { if (false) { let y = 1; }; y }; f()", out: Null},
+		"call_local_not_left_over":    {input: `let g = fn() { let s = "secret"; s }; let f = fn() { if (false) { let y = 1; }; y }; g(); f()`, out: Null},
+		"call_locals_globals":         {input: "let g = 50; let f = fn() { let l = 1; g - l }; f() + f()", out: &object.Integer{Value: 98}},
+		"call_nested_locals":          {input: "let a = fn(x) { let y = x + 1; y }; let b = fn(x) { let y = a(x) * 2; y }; b(1)", out: &object.Integer{Value: 4}},
+		"call_first_class":            {input: "let apply = fn(f, x) { f(x) }; let inc = fn(x) { x + 1 }; apply(inc, 41)", out: &object.Integer{Value: 42}},
+		"call_recursive":              {input: "let sum = fn(n) { if (n) { n + sum(n - 1) } else { 0 } }; sum(10)", out: &object.Integer{Value: 55}},
+		"minus":                       {input: "-5", out: &object.Integer{Value: -5}},
+		"minus_expression":            {input: "-(2 + 3) * -2", out: &object.Integer{Value: 10}},
+		"minus_binary":                {input: "10 - -10", out: &object.Integer{Value: 20}},
+		"bang_true":                   {input: "!true", out: False},
+		"bang_false":                  {input: "!false", out: True},
+		"bang_integer":                {input: "!5", out: False},
+		"bang_zero":                   {input: "!0", out: True},
+		"bang_null":                   {input: "!if (false) { 1 }", out: True},
+		"bang_bang":                   {input: "!!5", out: True},
+		"bang_function":               {input: "!fn() { 1 }", out: False},
+		"if_bang":                     {input: "if (!false) { 1 } else { 2 }", out: &object.Integer{Value: 1}},
+		"less_than":                   {input: "1 < 2", out: True},
+		"less_than_false":             {input: "2 < 1", out: False},
+		"less_than_or_equal":          {input: "2 <= 2", out: True},
+		"less_than_or_equal_false":    {input: "3 <= 2", out: False},
+		"greater_than":                {input: "1 > 2", out: False},
+		"greater_than_or_equal":       {input: "2 >= 2", out: True},
+		"greater_than_or_equal_false": {input: "1 >= 2", out: False},
+		"equal":                       {input: "1 + 1 == 2", out: True},
+		"not_equal":                   {input: "1 != 1", out: False},
+		"boolean_equal":               {input: "(1 < 2) == true", out: True},
+		"boolean_not_equal":           {input: "(1 > 2) != false", out: False},
+		"negative_comparison":         {input: "-1 < -2", out: False},
+		"if_comparison":               {input: "if (1 > 2) { 10 } else { 20 }", out: &object.Integer{Value: 20}},
+		"fib":                         {input: "let fib = fn(n) { if (n < 2) { return n; } fib(n - 1) + fib(n - 2) }; fib(15)", out: &object.Integer{Value: 610}},
+		"string":                      {input: `"monkey"`, out: &object.String{Value: "monkey"}},
+		"string_concat":               {input: `"mon" + "key"`, out: &object.String{Value: "monkey"}},
+		"string_concat_many":          {input: `let greet = fn(name) { "Hello, " + name + "!\n" }; greet("VM")`, out: &object.String{Value: "Hello, VM!\n"}},
+		"string_equal":                {input: `"a" + "b" == "ab"`, out: True},
+		"string_not_equal":            {input: `"a" != "a"`, out: False},
+		"string_not_equal_true":       {input: `"a" != "b"`, out: True},
+		"string_equal_integer":        {input: `"1" == 1`, out: False},
+		"string_truthy":               {input: `if ("") { 1 } else { 2 }`, out: &object.Integer{Value: 1}},
+		"closure":                     {input: "let newAdder = fn(a) { fn(b) { a + b } }; let addTwo = newAdder(2); addTwo(3)", out: &object.Integer{Value: 5}},
+		"closure_nested":              {input: "let f = fn(a) { fn(b) { fn(c) { a * 100 + b * 10 + c } } }; f(1)(2)(3)", out: &object.Integer{Value: 123}},
+		"closure_captures_local":      {input: "let f = fn() { let x = 7; let g = fn() { x }; g }; f()()", out: &object.Integer{Value: 7}},
+		"closure_callback":            {input: "let twice = fn(f, x) { f(f(x)) }; let k = 3; twice(fn(x) { x * k }, 2)", out: &object.Integer{Value: 18}},
+		"closure_counter":             {input: "let makeCounter = fn(start) { fn(step) { start + step } }; let c = makeCounter(10); c(1) + c(2)", out: &object.Integer{Value: 23}},
+		"closure_recursive_local":     {input: "let outer = fn() { let fact = fn(n) { if (n) { n * fact(n - 1) } else { 1 } }; fact(5) }; outer()", out: &object.Integer{Value: 120}},
+		"closure_recursive_captures":  {input: "let mk = fn(step) { let go = fn(n) { if (n) { step + go(n - 1) } else { 0 } }; go }; mk(3)(4)", out: &object.Integer{Value: 12}},
+		"array_empty":                 {input: "[]", out: &object.Array{Elements: []object.Object{}}},
+		"array":                       {input: `[1, "a", 1 < 2]`, out: &object.Array{Elements: []object.Object{&object.Integer{Value: 1}, &object.String{Value: "a"}, True}}},
+		"array_nested":                {input: "[[1], [2 + 3]]", out: &object.Array{Elements: []object.Object{&object.Array{Elements: []object.Object{&object.Integer{Value: 1}}}, &object.Array{Elements: []object.Object{&object.Integer{Value: 5}}}}}},
+		"index":                       {input: "[1, 2, 3][1]", out: &object.Integer{Value: 2}},
+		"index_expression":            {input: "let a = [1, 2, 3]; a[0 + 2] * a[0]", out: &object.Integer{Value: 3}},
+		"index_nested":                {input: "[[1, 2], [3, 4]][1][0]", out: &object.Integer{Value: 3}},
+		"index_negative":              {input: "[1, 2, 3][-1]", out: &object.Integer{Value: 3}},
+		"index_negative_first":        {input: "[1, 2, 3][-3]", out: &object.Integer{Value: 1}},
+		"index_out_of_range":          {input: "[1, 2, 3][3]", out: Null},
+		"index_negative_out_of_range": {input: "[1, 2, 3][-4]", out: Null},
+		"index_empty":                 {input: "[][0]", out: Null},
+		"hash_index_string":           {input: `{"a": 1, "b": 2}["b"]`, out: &object.Integer{Value: 2}},
+		"hash_index_integer":          {input: "{1: 10, 2: 20}[1 + 1]", out: &object.Integer{Value: 20}},
+		"hash_index_boolean":          {input: "{true: 1, false: 0}[1 > 2]", out: &object.Integer{Value: 0}},
+		"hash_keys_by_type":           {input: `let h = {1: "int", "1": "string"}; h["1"]`, out: &object.String{Value: "string"}},
+		"hash_missing_key":            {input: `{"a": 1}["b"]`, out: Null},
+		"hash_empty":                  {input: "{}[0]", out: Null},
+		"hash_duplicate_key":          {input: `{"a": 1, "a": 2}["a"]`, out: &object.Integer{Value: 2}},
+		"hash_nested":                 {input: `{"xs": [1, {"y": 5}]}["xs"][1]["y"]`, out: &object.Integer{Value: 5}},
+		"builtin_len_string":          {input: `len("four")`, out: &object.Integer{Value: 4}},
+		"builtin_len_array":           {input: "len([1, 2, 3])", out: &object.Integer{Value: 3}},
+		"builtin_len_hash":            {input: `len({"a": 1, "a": 2, "b": 3})`, out: &object.Integer{Value: 2}},
+		"builtin_first":               {input: "first([1, 2, 3])", out: &object.Integer{Value: 1}},
+		"builtin_first_empty":         {input: "first([])", out: Null},
+		"builtin_last":                {input: "last([1, 2, 3])", out: &object.Integer{Value: 3}},
+		"builtin_rest":                {input: "rest([1, 2, 3])", out: &object.Array{Elements: []object.Object{&object.Integer{Value: 2}, &object.Integer{Value: 3}}}},
+		"builtin_rest_empty":          {input: "rest([])", out: Null},
+		"builtin_push":                {input: "let a = [1]; let b = push(a, 2); len(a) * 10 + len(b)", out: &object.Integer{Value: 12}},
+		"builtin_puts":                {input: "puts()", out: Null},
+		"builtin_in_closure":          {input: "let sum = fn(xs) { if (len(xs) == 0) { 0 } else { first(xs) + sum(rest(xs)) } }; sum([1, 2, 3, 4])", out: &object.Integer{Value: 10}},
+		"builtin_as_value":            {input: "let apply = fn(f, x) { f(x) }; apply(len, [1, 2])", out: &object.Integer{Value: 2}},
+		"builtin_shadowed":            {input: "let len = fn(x) { 42 }; len([])", out: &object.Integer{Value: 42}},
+		"builtin_host_defined":        {input: "double(21)", out: &object.Integer{Value: 42}},
+		"index_in_function":           {input: "let first = fn(xs) { xs[0] }; first([7, 8])", out: &object.Integer{Value: 7}},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			vm := New(compileSource(t, tc.input))
+
+			err := vm.Run()
+			assert.NoError(t, err, name)
+			assert.Equal(t, tc.out, vm.LastPoppedStackElem())
+		})
+	}
+}
+
+func TestVmGlobalsStore(t *testing.T) {
+	globals := make([]object.Object, GlobalsSize)
+	symbols := compiler.NewSymbolTable()
+	constants := []object.Object{}
+
+	run := func(input string) object.Object {
+		c := compiler.NewWithState(symbols, constants)
+		assert.NoError(t, c.Compile(parser.New(lexer.New(input)).ParseProgram()))
+
+		byteCode := c.ByteCode()
+		constants = byteCode.Constants
+
+		vm := NewWithGlobalsStore(byteCode, globals)
+		assert.NoError(t, vm.Run())
+
+		return vm.LastPoppedStackElem()
+	}
+
+	run("let a = 40;")
+	run("let b = a + 1;")
+	assert.Equal(t, &object.Integer{Value: 42}, run("a + b - 39"))
+}
+
+func TestVmGlobalsStoreTooSmall(t *testing.T) {
+	vm := NewWithGlobalsStore(compileSource(t, "let a = 1; let b = 2;"), make([]object.Object, 1))
+
+	assert.EqualError(t, vm.Run(), "global 1 out of range, the globals store has 1 slots")
+}
+
+func TestVmComparison(t *testing.T) {
+	type testCase struct {
+		op    code.OpCode
+		left  object.Object
+		right object.Object
+		out   object.Object
+	}
+
+	truthy := True
+	falsy := False
+
+	testCases := map[string]testCase{
+		"equal":               {code.OpEqual, &object.Integer{Value: 1}, &object.Integer{Value: 1}, truthy},
+		"not_equal":           {code.OpEqual, &object.Integer{Value: 1}, &object.Integer{Value: 2}, falsy},
+		"not_equal_op":        {code.OpNotEqual, &object.Integer{Value: 1}, &object.Integer{Value: 2}, truthy},
+		"greater_than":        {code.OpGreaterThan, &object.Integer{Value: 2}, &object.Integer{Value: 1}, truthy},
+		"greater_than_order":  {code.OpGreaterThan, &object.Integer{Value: 1}, &object.Integer{Value: 2}, falsy},
+		"null_equal_null":     {code.OpEqual, Null, Null, truthy},
+		"null_not_equal_int":  {code.OpNotEqual, Null, &object.Integer{Value: 0}, truthy},
+		"null_equal_integer":  {code.OpEqual, Null, &object.Integer{Value: 0}, falsy},
+		"greater_than_equals": {code.OpGreaterThan, &object.Integer{Value: 3}, &object.Integer{Value: 3}, falsy},
+		"true_equal_true":     {code.OpEqual, True, True, truthy},
+		"true_equal_false":    {code.OpEqual, True, False, falsy},
+		"true_not_equal_null": {code.OpNotEqual, True, Null, truthy},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			vm := New(&compiler.ByteCode{
+				Instructions: code.NewBuilder().
+					Add(code.OpConstant, 0).
+					Add(code.OpConstant, 1).
+					Add(tc.op).
+					Add(code.OpPop).
+					Build(),
+				Constants: []object.Object{tc.left, tc.right},
+			})
+
+			err := vm.Run()
+			assert.NoError(t, err, name)
+			assert.Equal(t, tc.out, vm.LastPoppedStackElem())
+		})
+	}
+}
+
+func TestVmRunErrors(t *testing.T) {
+	testCases := map[string]struct {
+		input string
+		err   string
+	}{
+		"division_by_zero":       {input: "1 / 0", err: "division by zero: 1 / 0"},
+		"division_by_expression": {input: "10 / (5 - 5)", err: "division by zero: 10 / 0"},
+		"add_null":               {input: "1 + if (0) { 1 }", err: "1 or null is not of integer type"},
+		"add_booleans":           {input: "true + false", err: "true or false is not of integer type"},
+		"add_unset_local":        {input: "let f = fn() { if (false) { let y = 1; }; y + 1 }; f()", err: "null or 1 is not of integer type"},
+		"minus_boolean":          {input: "-true", err: "unsupported type for negation: Boolean"},
+		"compare_booleans":       {input: "true > false", err: "unknown operator: OpGreaterThan (Boolean Boolean)"},
+		"string_minus":           {input: `"a" - "b"`, err: "unknown string operator: OpSub"},
+		"string_plus_integer":    {input: `"a" + 1`, err: "a or 1 is not of integer type"},
+		"string_ordering":        {input: `"a" < "b"`, err: "unknown operator: OpLessThan (String String)"},
+		"call_non_function":      {input: "1()", err: "calling non-function: Integer"},
+		"call_too_few_args":      {input: "fn(a) { a }()", err: "wrong number of arguments: want=1, got=0"},
+		"call_too_many_args":     {input: "fn() { 1 }(1, 2)", err: "wrong number of arguments: want=0, got=2"},
+		"index_non_array":        {input: "1[0]", err: "index operator not supported: Integer[Integer]"},
+		"index_non_integer":      {input: `[1][true]`, err: "index operator not supported: Array[Boolean]"},
+		"hash_function_key":      {input: "{fn() { 1 }: 1}", err: "unusable as hash key: Closure"},
+		"hash_index_array_key":   {input: "{1: 1}[[1]]", err: "unusable as hash key: Array"},
+		"builtin_wrong_args":     {input: "len(1, 2)", err: "wrong number of arguments to len: want=1, got=2"},
+		"builtin_wrong_type":     {input: "len(1)", err: "argument to len not supported: Integer"},
+		"builtin_push_non_array": {input: "push(1, 1)", err: "argument to push must be Array, got Integer"},
+		"call_unbounded":         {input: "let f = fn() { f() }; f()", err: "call depth limit exceeded: more than 1023 nested calls"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			vm := New(compileSource(t, tc.input))
+
+			err := vm.Run()
+			assert.EqualError(t, err, tc.err, name)
+		})
+	}
+}
+
+func TestVmInspect(t *testing.T) {
+	testCases := map[string]struct {
+		input string
+		out   string
+	}{
+		"array":          {input: `[1, "a", true, [2]]`, out: "[1, a, true, [2]]"},
+		"hash":           {input: `{"b": 1, "a": [2], 3: {true: if (false) { 1 }}}`, out: "{b: 1, a: [2], 3: {true: null}}"},
+		"hash_reinserts": {input: `{"b": 1, "a": 2, "b": 3}`, out: "{b: 3, a: 2}"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			// repeat to catch output depending on map iteration order
+			for i := 0; i < 10; i++ {
+				vm := New(compileSource(t, tc.input))
+
+				assert.NoError(t, vm.Run())
+				assert.Equal(t, tc.out, vm.LastPoppedStackElem().Inspect())
+			}
+		})
+	}
+}
+
+func TestVmRunDecoded(t *testing.T) {
+	input := "let fib = fn(n) { if (n < 2) { return n; } fib(n - 1) + fib(n - 2) };\nfib(10) + len(\"abc\")"
+
+	var buf bytes.Buffer
+	assert.NoError(t, compileSource(t, input).Encode(&buf))
+
+	byteCode, err := compiler.Decode(&buf)
+	assert.NoError(t, err)
+
+	vm := New(byteCode)
+	assert.NoError(t, vm.Run())
+	assert.Equal(t, &object.Integer{Value: 58}, vm.LastPoppedStackElem())
+}